@@ -1,7 +1,13 @@
 package main
 
-import "AdvancedProgramming/internal/app"
+import (
+	"log"
+
+	"AdvancedProgramming/internal/app"
+)
 
 func main() {
-	app.Run()
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
+	}
 }
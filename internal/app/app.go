@@ -1,28 +1,55 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"AdvancedProgramming/internal/auth"
 	"AdvancedProgramming/internal/cars"
+	"AdvancedProgramming/internal/httpx"
 	"AdvancedProgramming/internal/infrastructure"
+	"AdvancedProgramming/internal/media"
 	"AdvancedProgramming/internal/orders/handlers"
+	"AdvancedProgramming/internal/orders/queue"
 	"AdvancedProgramming/internal/orders/repositories"
 	"AdvancedProgramming/internal/orders/services"
 	"AdvancedProgramming/internal/webui"
 )
 
-func Run() {
+// shutdownTimeout bounds how long Run waits for in-flight requests and queued
+// order processing after a shutdown signal.
+const shutdownTimeout = 15 * time.Second
+
+// Run serves the API until a shutdown signal arrives. It returns the error
+// that stopped the HTTP server, e.g. when :8080 cannot be bound, after
+// in-flight work was drained and the database closed.
+func Run() error {
 	if err := infrastructure.InitDatabase(); err != nil {
 		log.Printf("Database init warning: %v", err)
 	}
 	defer infrastructure.CloseDatabase()
 
+	keySet, err := auth.LoadKeySet()
+	if err != nil {
+		log.Fatalf("JWT keys: %v", err)
+	}
+	auth.SetKeySet(keySet)
+
+	auth.SetUserStore(auth.NewUserStore())
+	auth.SetTokenStore(auth.NewTokenStore())
+	auth.SetNotifier(auth.NewNotifier())
+	auth.SetAttemptStore(auth.NewAttemptStore())
+	auth.SetRequireAdminMFA(strings.EqualFold(os.Getenv("REQUIRE_ADMIN_2FA"), "true"))
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -34,29 +61,65 @@ func Run() {
 				"Auth:\n"+
 				"  POST /auth/register\n"+
 				"  POST /auth/login\n"+
+				"  POST /auth/refresh\n"+
+				"  POST /auth/logout\n"+
+				"  POST /auth/password\n"+
+				"  POST /auth/password/forgot\n"+
+				"  POST /auth/password/reset\n"+
+				"  POST /auth/unlock         (admin)\n"+
+				"  POST /auth/login/2fa\n"+
+				"  POST /auth/2fa/setup\n"+
+				"  POST /auth/2fa/enable\n"+
+				"  POST /auth/2fa/disable\n"+
+				"  POST /auth/2fa/recovery-codes\n"+
+				"  GET  /.well-known/jwks.json\n"+
 				"  GET  /auth/me\n"+
-				"  POST /auth/favorites/{carID}\n\n"+
+				"  GET    /auth/favorites\n"+
+				"  POST   /auth/favorites/{carID}\n"+
+				"  DELETE /auth/favorites/{carID}\n\n"+
+				"Admin:\n"+
+				"  GET    /admin/users?q=&role=&disabled= (admin)\n"+
+				"  GET    /admin/users/{id}  (admin)\n"+
+				"  PATCH  /admin/users/{id}  (admin)\n"+
+				"  DELETE /admin/users/{id}  (admin)\n\n"+
 				"Cars:\n"+
 				"  GET    /cars\n"+
 				"  GET    /cars/{id}\n"+
 				"  POST   /cars              (admin)\n"+
 				"  PUT    /cars/{id}         (admin)\n"+
-				"  DELETE /cars/{id}         (admin)\n\n"+
+				"  DELETE /cars/{id}         (admin)\n"+
+				"  GET    /cars/decode-vin/{vin} (admin)\n\n"+
+				"Car images:\n"+
+				"  GET    /cars/{id}/images\n"+
+				"  POST   /cars/{id}/images  (admin, multipart \"image\"/\"images\": JPEG, PNG or GIF, up to 10 MB each)\n"+
+				"  PUT    /cars/{id}/images/order (admin, {\"order\": [imageID, ...]})\n"+
+				"  PUT    /cars/{id}/images/{imageID}/cover (admin)\n"+
+				"  DELETE /cars/{id}/images/{imageID} (admin)\n"+
+				"  GET    /media/{key}       (image files and thumbnails, cached for a year)\n\n"+
 				"Orders:\n"+
 				"  POST   /orders            (user/admin)\n"+
 				"  GET    /orders            (admin)\n"+
 				"  GET    /orders/{id}       (admin)\n"+
 				"  PUT    /orders/{id}       (admin)\n"+
 				"  DELETE /orders/{id}       (admin)\n"+
+				"  GET    /orders/{id}/history (admin)\n"+
 				"  GET    /users/{id}/orders (admin)\n"+
 				"  GET    /orders/stats      (admin)\n"+
-				"  GET    /orders/search?q=  (admin)\n\n"+
+				"  GET    /orders/search?q=  (admin)\n"+
+				"  GET    /me/orders         (user/admin)\n"+
+				"  GET    /me/orders/{id}    (user/admin)\n"+
+				"  POST   /me/orders/{id}/cancel (user/admin)\n\n"+
 				"UI:\n"+
 				"  GET /ui/cars\n"+
 				"  GET /ui/cars/new\n"+
 				"  GET /ui/orders\n"+
+				"  GET /ui/favorites\n"+
 				"  GET /ui/login\n"+
-				"  GET /ui/register\n",
+				"  GET /ui/register\n\n"+
+				"=== Errors ===\n\n"+
+				"  {\"success\": false, \"error\": {\"code\", \"message\", \"details\", \"request_id\"}}\n"+
+				"  Send Accept: application/problem+json for RFC 7807 problem documents.\n"+
+				"  Every response carries X-Request-ID.\n",
 		)
 	})
 
@@ -67,49 +130,58 @@ func Run() {
 
 	mux.HandleFunc("/auth/register", auth.Register)
 	mux.HandleFunc("/auth/login", auth.Login)
+	mux.HandleFunc("/auth/refresh", auth.Refresh)
+	mux.HandleFunc("/.well-known/jwks.json", auth.JWKS)
+	mux.Handle("/auth/password", auth.AuthMiddleware(http.HandlerFunc(auth.ChangePasswordHandler)))
+	mux.HandleFunc("/auth/password/forgot", auth.ForgotPassword)
+	mux.HandleFunc("/auth/password/reset", auth.ResetPasswordHandler)
+	mux.Handle("/auth/unlock", auth.RequireRoles(http.HandlerFunc(auth.Unlock), auth.RoleAdmin))
+	mux.HandleFunc("/auth/login/2fa", auth.LoginMFA)
+	mux.Handle("/admin/users", auth.RequireRoles(http.HandlerFunc(auth.AdminUsers), auth.RoleAdmin))
+	mux.Handle("/admin/users/", auth.RequireRoles(http.HandlerFunc(auth.AdminUserByID), auth.RoleAdmin))
+	mux.Handle("/auth/2fa/setup", auth.AuthMiddleware(http.HandlerFunc(auth.SetupMFA)))
+	mux.Handle("/auth/2fa/enable", auth.AuthMiddleware(http.HandlerFunc(auth.EnableMFA)))
+	mux.Handle("/auth/2fa/disable", auth.AuthMiddleware(http.HandlerFunc(auth.DisableMFA)))
+	mux.Handle("/auth/2fa/recovery-codes", auth.AuthMiddleware(http.HandlerFunc(auth.RecoveryCodes)))
+	mux.Handle("/auth/logout", auth.AuthMiddleware(http.HandlerFunc(auth.Logout)))
 	mux.Handle("/auth/me", auth.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
 			return
 		}
 		username, ok := auth.UsernameFromContext(r.Context())
 		if !ok {
-			http.Error(w, "forbidden", http.StatusForbidden)
+			httpx.Error(w, r, http.StatusForbidden, "forbidden", "forbidden")
 			return
 		}
 		user, ok := auth.GetUserByUsername(username)
 		if !ok {
-			http.Error(w, "user not found", http.StatusNotFound)
+			httpx.Error(w, r, http.StatusNotFound, "user_not_found", "user not found")
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(map[string]any{"user": user})
 	})))
 
-	mux.Handle("/auth/favorites/", auth.RequireRoles(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		username, _ := auth.UsernameFromContext(r.Context())
-		idStr := strings.TrimPrefix(r.URL.Path, "/auth/favorites/")
-		carID, err := strconv.Atoi(idStr)
-		if err != nil || carID <= 0 {
-			http.Error(w, "invalid car id", http.StatusBadRequest)
-			return
-		}
-		user, err := auth.AddFavorite(username, carID)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]any{"message": "favorite added", "user": user})
-	}), auth.RoleUser, auth.RoleAdmin))
-
-	carRepo := cars.NewRepository()
+	carRepo, err := cars.NewRepository()
+	if err != nil {
+		log.Fatalf("Car repository: %v", err)
+	}
 	carService := cars.NewService(carRepo)
 	carHandler := cars.NewHandler(carService)
+
+	mediaStorage, err := media.NewStorage()
+	if err != nil {
+		log.Fatalf("Media storage: %v", err)
+	}
+	carService.SetImageStorage(mediaStorage)
+	mux.Handle(cars.MediaPrefix, media.Handler(mediaStorage, cars.MediaPrefix))
+
+	carService.OnDelete(func(id int) {
+		if err := auth.RemoveFavoriteFromAll(id); err != nil {
+			log.Printf("Failed to remove deleted car %d from favorites: %v", id, err)
+		}
+	})
 	mux.HandleFunc("/cars", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			auth.RequireRoles(http.HandlerFunc(carHandler.Cars), auth.RoleAdmin).ServeHTTP(w, r)
@@ -118,22 +190,31 @@ func Run() {
 		carHandler.Cars(w, r)
 	})
 	mux.HandleFunc("/cars/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPut || r.Method == http.MethodDelete {
+		if r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodDelete {
 			auth.RequireRoles(http.HandlerFunc(carHandler.CarByID), auth.RoleAdmin).ServeHTTP(w, r)
 			return
 		}
 		carHandler.CarByID(w, r)
 	})
 
+	mux.Handle("/cars/decode-vin/", auth.RequireRoles(http.HandlerFunc(carHandler.DecodeVIN), auth.RoleAdmin))
+
+	favorites := favoritesHandler{cars: carService}
+	mux.Handle("/auth/favorites", auth.RequireRoles(http.HandlerFunc(favorites.List), auth.RoleUser, auth.RoleAdmin))
+	mux.Handle("/auth/favorites/", auth.RequireRoles(http.HandlerFunc(favorites.ByCarID), auth.RoleUser, auth.RoleAdmin))
+
 	webui.Register(mux, carService)
 
 	orderRepo := repositories.NewOrderRepository()
-	orderService := services.NewOrderService(&orderRepo)
+	if err := orderRepo.Init(); err != nil {
+		log.Fatalf("Order repository: %v", err)
+	}
+	orderService := services.NewOrderService(&orderRepo, carInventory{cars: carService}, queue.NewQueue())
 	orderHandler := handlers.NewOrderHandler(orderService)
 
 	mux.Handle("/orders/stats", auth.RequireRoles(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
 			return
 		}
 		orderHandler.GetOrderStats(w, r)
@@ -141,7 +222,7 @@ func Run() {
 
 	mux.Handle("/orders/search", auth.RequireRoles(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
 			return
 		}
 		orderHandler.SearchOrders(w, r)
@@ -154,26 +235,66 @@ func Run() {
 		case http.MethodGet:
 			auth.RequireRoles(http.HandlerFunc(orderHandler.GetAllOrders), auth.RoleAdmin).ServeHTTP(w, r)
 		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
 		}
 	})
 
 	mux.Handle("/orders/", auth.RequireRoles(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet && r.Method != http.MethodPut && r.Method != http.MethodDelete {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
 			return
 		}
 		orderHandler.HandleOrderByID(w, r)
 	}), auth.RoleAdmin))
 
+	mux.Handle("/me/orders", auth.RequireRoles(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+			return
+		}
+		orderHandler.MyOrders(w, r)
+	}), auth.RoleUser, auth.RoleAdmin))
+
+	mux.Handle("/me/orders/", auth.RequireRoles(http.HandlerFunc(orderHandler.HandleMyOrder), auth.RoleUser, auth.RoleAdmin))
+
 	mux.Handle("/users/", auth.RequireRoles(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
 			return
 		}
 		orderHandler.GetUserOrders(w, r)
 	}), auth.RoleAdmin))
 
-	fmt.Println("Car Store API started at http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	srv := &http.Server{Addr: ":8080", Handler: httpx.RequestID(mux)}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		fmt.Println("Car Store API started at http://localhost:8080")
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	var runErr error
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			runErr = fmt.Errorf("HTTP server: %w", err)
+		}
+	case <-ctx.Done():
+		log.Println("Shutdown signal received")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server shutdown: %v", err)
+	}
+	if err := orderService.Close(shutdownCtx); err != nil {
+		log.Printf("Order service shutdown: %v", err)
+	}
+	log.Println("Server stopped")
+	return runErr
 }
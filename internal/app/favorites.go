@@ -0,0 +1,97 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"AdvancedProgramming/internal/auth"
+	"AdvancedProgramming/internal/cars"
+	"AdvancedProgramming/internal/httpx"
+)
+
+// favoritesHandler serves /auth/favorites. It lives here rather than in auth
+// because it needs the car catalog to validate and hydrate favorites.
+type favoritesHandler struct {
+	cars *cars.Service
+}
+
+func (h favoritesHandler) List(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	username, _ := auth.UsernameFromContext(r.Context())
+
+	items, err := auth.FavoriteItems(username, h.cars.GetMany)
+	if err != nil {
+		if errors.Is(err, auth.ErrUserNotFound) {
+			httpx.Error(w, r, http.StatusNotFound, "user_not_found", "user not found")
+			return
+		}
+		log.Printf("[FAVORITES] failed to load favorites for %s: %v", username, err)
+		httpx.Error(w, r, http.StatusInternalServerError, "server_error", "failed to load favorites")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"favorites": items})
+}
+
+func (h favoritesHandler) ByCarID(w http.ResponseWriter, r *http.Request) {
+	username, _ := auth.UsernameFromContext(r.Context())
+	idStr := strings.TrimPrefix(r.URL.Path, "/auth/favorites/")
+	carID, err := strconv.Atoi(idStr)
+	if err != nil || carID <= 0 {
+		httpx.Error(w, r, http.StatusBadRequest, "bad_id", "invalid car id")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if _, err := h.cars.GetByID(carID); err != nil {
+			if errors.Is(err, cars.ErrNotFound) {
+				httpx.Error(w, r, http.StatusNotFound, "car_not_found", "car not found")
+				return
+			}
+			httpx.Error(w, r, http.StatusInternalServerError, "server_error", "failed to load car")
+			return
+		}
+		user, err := auth.AddFavorite(username, carID)
+		if err != nil {
+			favoriteError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"message": "favorite added", "user": user})
+
+	case http.MethodDelete:
+		user, err := auth.RemoveFavorite(username, carID)
+		if err != nil {
+			favoriteError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"message": "favorite removed", "user": user})
+
+	default:
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
+
+// favoriteError reports the client errors of AddFavorite and RemoveFavorite;
+// anything else is logged and reported as a server error.
+func favoriteError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		httpx.Error(w, r, http.StatusNotFound, "user_not_found", err.Error())
+	case errors.Is(err, auth.ErrInvalidCarID):
+		httpx.Error(w, r, http.StatusBadRequest, "bad_id", err.Error())
+	default:
+		log.Printf("[FAVORITES] %s %s: %v", r.Method, r.URL.Path, err)
+		httpx.Error(w, r, http.StatusInternalServerError, "server_error", "Internal server error")
+	}
+}
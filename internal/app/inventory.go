@@ -0,0 +1,44 @@
+package app
+
+import (
+	"errors"
+
+	"AdvancedProgramming/internal/cars"
+	"AdvancedProgramming/internal/orders/services"
+)
+
+// carInventory adapts cars.Service to services.CarInventory, translating
+// cars errors into the ones the order service understands.
+type carInventory struct {
+	cars *cars.Service
+}
+
+func (c carInventory) Reserve(carID int) error {
+	return translateCarErr(c.cars.Reserve(carID))
+}
+
+func (c carInventory) Release(carID int) error {
+	return translateCarErr(c.cars.Release(carID))
+}
+
+func (c carInventory) MarkSold(carID int) error {
+	return translateCarErr(c.cars.MarkSold(carID))
+}
+
+func (c carInventory) Lookup(carID int) (services.CarInfo, error) {
+	car, err := c.cars.GetByID(carID)
+	if err != nil {
+		return services.CarInfo{}, translateCarErr(err)
+	}
+	return services.CarInfo{Status: string(car.Status), Price: car.Price}, nil
+}
+
+func translateCarErr(err error) error {
+	switch {
+	case errors.Is(err, cars.ErrNotFound):
+		return services.ErrCarNotFound
+	case errors.Is(err, cars.ErrNotAvailable):
+		return services.ErrCarUnavailable
+	}
+	return err
+}
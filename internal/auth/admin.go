@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"AdvancedProgramming/internal/httpx"
+)
+
+const (
+	defaultUserPageLimit = 20
+	maxUserPageLimit     = 100
+)
+
+var (
+	ErrInvalidRole   = errors.New("role must be user or admin")
+	ErrEmptyUsername = errors.New("username must not be empty")
+	ErrSelfModify    = errors.New("admins cannot demote, disable or delete themselves")
+)
+
+// UpdateUserRequest is the body of PATCH /admin/users/{id}. Only the fields
+// that are present are changed.
+type UpdateUserRequest struct {
+	Username *string `json:"username,omitempty"`
+	Role     *string `json:"role,omitempty"`
+	Disabled *bool   `json:"disabled,omitempty"`
+}
+
+func ListUsers(q UserQuery) ([]User, UserPage, error) {
+	page, err := users().List(q)
+	if err != nil {
+		return nil, UserPage{}, err
+	}
+	out := make([]User, 0, len(page.Items))
+	for _, rec := range page.Items {
+		out = append(out, toUser(rec))
+	}
+	return out, page, nil
+}
+
+func GetUserByID(id int) (User, error) {
+	rec, err := users().GetByID(id)
+	if err != nil {
+		return User{}, err
+	}
+	return toUser(rec), nil
+}
+
+// UpdateUser applies an admin's changes to user id. A role change or
+// disabling the account bumps the token version, so tokens carrying the old
+// role or issued before the ban stop working at once. Renaming ends every
+// session as well, since tokens are bound to the username.
+func UpdateUser(adminID, id int, req UpdateUserRequest) (User, error) {
+	var role Role
+	if req.Role != nil {
+		role = Role(strings.ToLower(strings.TrimSpace(*req.Role)))
+		if role != RoleUser && role != RoleAdmin {
+			return User{}, ErrInvalidRole
+		}
+	}
+	if id == adminID && ((req.Role != nil && role != RoleAdmin) || (req.Disabled != nil && *req.Disabled)) {
+		return User{}, ErrSelfModify
+	}
+
+	rec, err := users().GetByID(id)
+	if err != nil {
+		return User{}, err
+	}
+
+	if req.Username != nil {
+		name := strings.TrimSpace(*req.Username)
+		if name == "" {
+			return User{}, ErrEmptyUsername
+		}
+		if name != rec.Username {
+			if rec, err = users().Rename(id, name); err != nil {
+				return User{}, err
+			}
+		}
+	}
+
+	if req.Role != nil || req.Disabled != nil {
+		rec, err = users().Update(rec.Username, func(rec UserRecord) (UserRecord, error) {
+			revoke := false
+			if req.Role != nil && rec.Role != role {
+				rec.Role = role
+				revoke = true
+			}
+			if req.Disabled != nil && rec.Disabled != *req.Disabled {
+				rec.Disabled = *req.Disabled
+				revoke = revoke || rec.Disabled
+			}
+			if revoke {
+				rec.TokenVersion++
+			}
+			rec.UpdatedAt = time.Now().UTC()
+			return rec, nil
+		})
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	return toUser(rec), nil
+}
+
+func DeleteUser(adminID, id int) error {
+	if id == adminID {
+		return ErrSelfModify
+	}
+	return users().Delete(id)
+}
+
+func adminUserStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUserExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrSelfModify):
+		return http.StatusForbidden
+	case errors.Is(err, ErrInvalidRole), errors.Is(err, ErrEmptyUsername), errors.Is(err, ErrInvalidCursor):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func parseUserQuery(r *http.Request) (UserQuery, error) {
+	v := r.URL.Query()
+	q := UserQuery{
+		Search: strings.TrimSpace(v.Get("q")),
+		Role:   Role(strings.ToLower(strings.TrimSpace(v.Get("role")))),
+		Limit:  defaultUserPageLimit,
+		Cursor: strings.TrimSpace(v.Get("cursor")),
+	}
+	var verr httpx.ValidationError
+	if q.Role != "" && q.Role != RoleUser && q.Role != RoleAdmin {
+		verr.Add("role", "invalid", ErrInvalidRole.Error())
+	}
+	if raw := v.Get("disabled"); raw != "" {
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			verr.Add("disabled", "invalid", "disabled must be true or false")
+		}
+		q.Disabled = &b
+	}
+	if raw := v.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		switch {
+		case err != nil || n <= 0:
+			verr.Add("limit", "invalid", "limit must be a positive integer")
+		case n > maxUserPageLimit:
+			verr.Add("limit", "out_of_range", "limit must be between 1 and "+strconv.Itoa(maxUserPageLimit))
+		default:
+			q.Limit = n
+		}
+	}
+	if err := verr.Err(); err != nil {
+		return UserQuery{}, err
+	}
+	return q, nil
+}
+
+// AdminUsers serves GET /admin/users and must run behind RequireRoles.
+func AdminUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	q, err := parseUserQuery(r)
+	if err != nil {
+		httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("bad_query", "Invalid query parameters").WithDetails(httpx.Details(err)...))
+		return
+	}
+
+	list, page, err := ListUsers(q)
+	if err != nil {
+		writeError(w, r, adminUserStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"users": list,
+		"meta": httpx.Meta{
+			Total:      page.Total,
+			Limit:      q.Limit,
+			NextCursor: page.NextCursor,
+		},
+	})
+}
+
+// AdminUserByID serves GET, PATCH and DELETE /admin/users/{id} and must run
+// behind RequireRoles.
+func AdminUserByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/users/"), "/"))
+	if err != nil || id <= 0 {
+		httpx.Error(w, r, http.StatusBadRequest, "bad_id", "invalid user id")
+		return
+	}
+	adminID, _ := UserIDFromContext(r.Context())
+	adminName, _ := UsernameFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		user, err := GetUserByID(id)
+		if err != nil {
+			writeError(w, r, adminUserStatus(err), err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(user)
+
+	case http.MethodPatch:
+		var req UpdateUserRequest
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			httpx.Error(w, r, http.StatusBadRequest, "bad_json", "invalid input")
+			return
+		}
+
+		user, err := UpdateUser(adminID, id, req)
+		if err != nil {
+			writeError(w, r, adminUserStatus(err), err)
+			return
+		}
+		log.Printf("[AUTH] %s updated user %d", adminName, id)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"message": "user updated",
+			"user":    user,
+		})
+
+	case http.MethodDelete:
+		if err := DeleteUser(adminID, id); err != nil {
+			writeError(w, r, adminUserStatus(err), err)
+			return
+		}
+		log.Printf("[AUTH] %s deleted user %d", adminName, id)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"message": "user deleted"})
+
+	default:
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
@@ -4,15 +4,22 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
+
+	"AdvancedProgramming/internal/httpx"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrInvalidAdminKey    = errors.New("invalid admin key")
 )
 
 type Role string
@@ -28,6 +35,8 @@ type User struct {
 	Password  string `json:"password,omitempty"`
 	Role      Role   `json:"role"`
 	Favorites []int  `json:"favorites,omitempty"`
+	TwoFactor bool   `json:"two_factor_enabled"`
+	Disabled  bool   `json:"disabled,omitempty"`
 	CreatedAt string `json:"created_at"`
 	UpdatedAt string `json:"updated_at"`
 }
@@ -44,34 +53,41 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+// Claims is the validated content of an access token. ID is the token's
+// jti, used to revoke it on logout. MFA is set when the session passed a
+// TOTP or recovery code check.
 type Claims struct {
-	Username string
-	Role     Role
+	ID           string
+	UserID       int
+	Username     string
+	Role         Role
+	TokenVersion int
+	MFA          bool
+	ExpiresAt    time.Time
 }
 
-var jwtKey = func() []byte {
-	if v := os.Getenv("JWT_SECRET"); v != "" {
-		return []byte(v)
-	}
-	return []byte("my_secret_key_2026")
-}()
-
-var (
-	usersMu sync.RWMutex
-	nextID  int64
-	usersDB = make(map[string]UserRecord) // username -> record
-)
-
+// UserRecord is the stored user. TOTPPending holds a secret between setup
+// and enable; RecoveryCodes are SHA-256 hashes of the unused codes.
 type UserRecord struct {
-	ID           int
-	Username     string
-	PasswordHash string
-	Role         Role
-	Favorites    []int
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	ID            int       `bson:"id"`
+	Username      string    `bson:"username"`
+	PasswordHash  string    `bson:"password_hash"`
+	Role          Role      `bson:"role"`
+	Favorites     []int     `bson:"favorites"`
+	TokenVersion  int       `bson:"token_version,omitempty"`
+	Disabled      bool      `bson:"disabled,omitempty"`
+	TOTPEnabled   bool      `bson:"totp_enabled,omitempty"`
+	TOTPSecret    string    `bson:"totp_secret,omitempty"`
+	TOTPPending   string    `bson:"totp_pending,omitempty"`
+	TOTPLastStep  int64     `bson:"totp_last_step,omitempty"`
+	RecoveryCodes []string  `bson:"recovery_codes,omitempty"`
+	CreatedAt     time.Time `bson:"created_at"`
+	UpdatedAt     time.Time `bson:"updated_at"`
 }
 
+// maxPasswordBytes is the longest password bcrypt accepts.
+const maxPasswordBytes = 72
+
 func HashPassword(password string) (string, error) {
 	if password == "" {
 		return "", errors.New("empty password")
@@ -84,19 +100,38 @@ func CheckPasswordHash(password, hash string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
 
-func GenerateJWT(username string, role Role) (string, error) {
+// GenerateJWT signs a short-lived access token. tokenVersion must match the
+// user's current version for the token to be accepted; mfa records whether
+// the login passed a second factor.
+func GenerateJWT(userID int, username string, role Role, tokenVersion int, mfa bool) (string, error) {
 	if username == "" {
 		return "", errors.New("empty username")
 	}
+	if userID <= 0 {
+		return "", errors.New("invalid user id")
+	}
+
+	ks, err := keys()
+	if err != nil {
+		return "", err
+	}
+
+	amr := []string{"pwd"}
+	if mfa {
+		amr = append(amr, "otp")
+	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	now := time.Now()
+	return ks.sign(jwt.MapClaims{
+		"jti":      randomToken(16),
+		"uid":      userID,
 		"username": username,
 		"role":     role,
-		"exp":      time.Now().Add(24 * time.Hour).Unix(),
-		"iat":      time.Now().Unix(),
+		"ver":      tokenVersion,
+		"amr":      amr,
+		"exp":      now.Add(accessTokenTTL).Unix(),
+		"iat":      now.Unix(),
 	})
-
-	return token.SignedString(jwtKey)
 }
 
 func ValidateToken(signedToken string) (Claims, error) {
@@ -104,12 +139,12 @@ func ValidateToken(signedToken string) (Claims, error) {
 		return Claims{}, errors.New("empty token")
 	}
 
-	token, err := jwt.Parse(signedToken, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtKey, nil
-	})
+	ks, err := keys()
+	if err != nil {
+		return Claims{}, err
+	}
+
+	token, err := jwt.Parse(signedToken, ks.keyFunc)
 	if err != nil {
 		return Claims{}, err
 	}
@@ -118,60 +153,99 @@ func ValidateToken(signedToken string) (Claims, error) {
 	if !ok || !token.Valid {
 		return Claims{}, fmt.Errorf("invalid token")
 	}
+	// MFA challenge tokens are signed with the same keys but grant nothing
+	if typ, _ := claims["typ"].(string); typ != "" {
+		return Claims{}, fmt.Errorf("invalid token type")
+	}
 
 	u, ok := claims["username"].(string)
 	if !ok || u == "" {
 		return Claims{}, fmt.Errorf("invalid token claims")
 	}
 
+	// numeric claims are decoded as float64
+	uid, ok := claims["uid"].(float64)
+	if !ok || uid <= 0 {
+		return Claims{}, fmt.Errorf("invalid token claims")
+	}
+
+	jti, ok := claims["jti"].(string)
+	if !ok || jti == "" {
+		return Claims{}, fmt.Errorf("invalid token claims")
+	}
+	ver, _ := claims["ver"].(float64)
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return Claims{}, fmt.Errorf("invalid token claims")
+	}
+
+	mfa := false
+	amr, _ := claims["amr"].([]any)
+	for _, m := range amr {
+		if m == "otp" {
+			mfa = true
+		}
+	}
+
 	roleStr, _ := claims["role"].(string)
 	role := Role(strings.ToLower(strings.TrimSpace(roleStr)))
 	if role != RoleAdmin {
 		role = RoleUser
 	}
 
-	return Claims{Username: u, Role: role}, nil
+	return Claims{
+		ID:           jti,
+		UserID:       int(uid),
+		Username:     u,
+		Role:         role,
+		TokenVersion: int(ver),
+		MFA:          mfa,
+		ExpiresAt:    exp.Time,
+	}, nil
 }
 
 func RegisterUser(req RegisterRequest) (User, error) {
 	username := strings.TrimSpace(req.Username)
 	password := strings.TrimSpace(req.Password)
-	if username == "" || password == "" {
-		return User{}, errors.New("username and password required")
+	var verr httpx.ValidationError
+	if username == "" {
+		verr.Add("username", "required", "username is required")
+	}
+	if password == "" {
+		verr.Add("password", "required", "password is required")
+	} else if len(password) > maxPasswordBytes {
+		verr.Add("password", "too_long", fmt.Sprintf("password must be at most %d bytes", maxPasswordBytes))
+	}
+	if err := verr.Err(); err != nil {
+		return User{}, err
 	}
 
 	role := RoleUser
 	if strings.EqualFold(strings.TrimSpace(req.Role), string(RoleAdmin)) {
 		adminSecret := os.Getenv("ADMIN_REGISTRATION_KEY")
 		if adminSecret == "" || req.AdminKey != adminSecret {
-			return User{}, errors.New("invalid admin key")
+			return User{}, ErrInvalidAdminKey
 		}
 		role = RoleAdmin
 	}
 
 	hashed, err := HashPassword(password)
 	if err != nil {
-		return User{}, errors.New("failed to hash password")
+		return User{}, fmt.Errorf("hash password: %w", err)
 	}
 
 	now := time.Now().UTC()
-	usersMu.Lock()
-	defer usersMu.Unlock()
-	if _, exists := usersDB[username]; exists {
-		return User{}, errors.New("user already exists")
-	}
-
-	id := int(atomic.AddInt64(&nextID, 1))
-	rec := UserRecord{
-		ID:           id,
+	rec, err := users().Create(UserRecord{
 		Username:     username,
 		PasswordHash: hashed,
 		Role:         role,
 		Favorites:    []int{},
 		CreatedAt:    now,
 		UpdatedAt:    now,
+	})
+	if err != nil {
+		return User{}, err
 	}
-	usersDB[username] = rec
 
 	go func(name string) {
 		time.Sleep(1 * time.Second)
@@ -181,63 +255,148 @@ func RegisterUser(req RegisterRequest) (User, error) {
 	return toUser(rec), nil
 }
 
-func LoginUser(req LoginRequest) (string, User, error) {
+// LoginUser checks the credentials of a login from ip. Repeated failures
+// for the username or the ip are throttled with a TooManyAttemptsError
+// before the password hash is even computed.
+func LoginUser(req LoginRequest, ip string) (TokenPair, User, error) {
 	username := strings.TrimSpace(req.Username)
 	password := strings.TrimSpace(req.Password)
 	if username == "" || password == "" {
-		return "", User{}, errors.New("username and password required")
+		return TokenPair{}, User{}, errors.New("username and password required")
+	}
+
+	checks := loginChecks(username, ip)
+	release, err := beginLogin(checks, time.Now())
+	if err != nil {
+		return TokenPair{}, User{}, err
+	}
+	defer release()
+
+	rec, err := users().GetByUsername(username)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return TokenPair{}, User{}, err
+	}
+
+	if err != nil || !CheckPasswordHash(password, rec.PasswordHash) {
+		recordFailure(checks, time.Now())
+		return TokenPair{}, User{}, ErrInvalidCredentials
 	}
 
-	usersMu.RLock()
-	rec, exists := usersDB[username]
-	usersMu.RUnlock()
+	if rec.Disabled {
+		return TokenPair{}, User{}, ErrAccountDisabled
+	}
+
+	// the failure counter keeps running until the second factor passed too
+	if rec.TOTPEnabled {
+		challenge, err := mfaChallenge(rec)
+		if err != nil {
+			return TokenPair{}, User{}, errors.New("failed to generate token")
+		}
+		return TokenPair{}, User{}, &MFARequiredError{Token: challenge}
+	}
 
-	if !exists || !CheckPasswordHash(password, rec.PasswordHash) {
-		return "", User{}, errors.New("invalid credentials")
+	if err := attempts().Reset(userKey(username)); err != nil {
+		log.Printf("[AUTH] failed to reset login attempts for %s: %v", username, err)
 	}
 
-	token, err := GenerateJWT(rec.Username, rec.Role)
+	pair, err := issueTokens(rec, "", false)
 	if err != nil {
-		return "", User{}, errors.New("failed to generate token")
+		return TokenPair{}, User{}, errors.New("failed to generate token")
 	}
 
-	return token, toUser(rec), nil
+	return pair, toUser(rec), nil
 }
 
 func GetUserByUsername(username string) (User, bool) {
-	usersMu.RLock()
-	rec, exists := usersDB[username]
-	usersMu.RUnlock()
-	if !exists {
+	rec, err := users().GetByUsername(username)
+	if err != nil {
 		return User{}, false
 	}
 	return toUser(rec), true
 }
 
+// ErrInvalidCarID is returned by AddFavorite for IDs no car can have.
+var ErrInvalidCarID = errors.New("invalid car id")
+
 func AddFavorite(username string, carID int) (User, error) {
 	if carID <= 0 {
-		return User{}, errors.New("invalid car id")
+		return User{}, ErrInvalidCarID
 	}
-	usersMu.Lock()
-	defer usersMu.Unlock()
-	rec, ok := usersDB[username]
-	if !ok {
-		return User{}, errors.New("user not found")
+	rec, err := users().Update(username, func(rec UserRecord) (UserRecord, error) {
+		for _, id := range rec.Favorites {
+			if id == carID {
+				return rec, nil
+			}
+		}
+		rec.Favorites = append(rec.Favorites, carID)
+		rec.UpdatedAt = time.Now().UTC()
+		return rec, nil
+	})
+	if err != nil {
+		return User{}, err
 	}
-	for _, id := range rec.Favorites {
-		if id == carID {
-			return toUser(rec), nil
+	return toUser(rec), nil
+}
+
+// RemoveFavorite drops carID from the user's favorites. Removing a car that
+// is not a favorite is not an error.
+func RemoveFavorite(username string, carID int) (User, error) {
+	rec, err := users().Update(username, func(rec UserRecord) (UserRecord, error) {
+		if !slices.Contains(rec.Favorites, carID) {
+			return rec, nil
 		}
+		rec.Favorites = slices.DeleteFunc(slices.Clone(rec.Favorites), func(id int) bool { return id == carID })
+		rec.UpdatedAt = time.Now().UTC()
+		return rec, nil
+	})
+	if err != nil {
+		return User{}, err
 	}
-	rec.Favorites = append(rec.Favorites, carID)
-	rec.UpdatedAt = time.Now().UTC()
-	usersDB[username] = rec
 	return toUser(rec), nil
 }
 
+// FavoriteItems loads the user's favorites with load, which returns the
+// items found and the IDs that no longer exist, e.g. cars deleted before
+// cleanup on delete was in place. Those IDs are pruned from the user.
+func FavoriteItems[T any](username string, load func(ids []int) ([]T, []int, error)) ([]T, error) {
+	rec, err := users().GetByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	items, missing, err := load(rec.Favorites)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range missing {
+		if _, err := RemoveFavorite(username, id); err != nil {
+			log.Printf("[FAVORITES] failed to prune car %d for %s: %v", id, username, err)
+		}
+	}
+	return items, nil
+}
+
+// RemoveFavoriteFromAll drops a deleted car from every user's favorites.
+func RemoveFavoriteFromAll(carID int) error {
+	return users().PullFavorite(carID)
+}
+
+// registerStatus maps RegisterUser errors; anything that is not the
+// client's fault is a server error.
+func registerStatus(err error) int {
+	var verr *httpx.ValidationError
+	switch {
+	case errors.As(err, &verr), errors.Is(err, ErrInvalidAdminKey):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUserExists):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
 func Register(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
 		return
 	}
 
@@ -245,17 +404,13 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
 	if err := dec.Decode(&req); err != nil {
-		http.Error(w, "invalid input", http.StatusBadRequest)
+		httpx.Error(w, r, http.StatusBadRequest, "bad_json", "invalid input")
 		return
 	}
 
 	user, err := RegisterUser(req)
 	if err != nil {
-		status := http.StatusBadRequest
-		if err.Error() == "user already exists" {
-			status = http.StatusConflict
-		}
-		http.Error(w, err.Error(), status)
+		writeError(w, r, registerStatus(err), err)
 		return
 	}
 
@@ -268,7 +423,7 @@ func Register(w http.ResponseWriter, r *http.Request) {
 
 func Login(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
 		return
 	}
 
@@ -276,18 +431,109 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
 	if err := dec.Decode(&req); err != nil {
-		http.Error(w, "invalid input", http.StatusBadRequest)
+		httpx.Error(w, r, http.StatusBadRequest, "bad_json", "invalid input")
+		return
+	}
+
+	pair, user, err := LoginUser(req, ClientIP(r))
+	if err != nil {
+		var throttled *TooManyAttemptsError
+		if errors.As(err, &throttled) {
+			writeTooManyAttempts(w, r, throttled)
+			return
+		}
+		if errors.Is(err, ErrAccountDisabled) {
+			writeError(w, r, http.StatusForbidden, err)
+			return
+		}
+		var mfa *MFARequiredError
+		if errors.As(err, &mfa) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"mfa_required": true,
+				"mfa_token":    mfa.Token,
+				"expires_in":   int(mfaChallengeTTL.Seconds()),
+			})
+			return
+		}
+		writeError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	writeTokens(w, pair, user)
+}
+
+func Refresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	var req RefreshRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		httpx.Error(w, r, http.StatusBadRequest, "bad_json", "invalid input")
 		return
 	}
 
-	token, user, err := LoginUser(req)
+	pair, user, err := RefreshTokens(req.RefreshToken)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		if errors.Is(err, ErrRefreshInvalid) || errors.Is(err, ErrRefreshReused) {
+			writeError(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		if errors.Is(err, ErrAccountDisabled) {
+			writeError(w, r, http.StatusForbidden, err)
+			return
+		}
+		httpx.Error(w, r, http.StatusInternalServerError, "server_error", "failed to refresh token")
+		return
+	}
+
+	writeTokens(w, pair, user)
+}
+
+// Logout must run behind AuthMiddleware; the body is optional.
+func Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		httpx.Error(w, r, http.StatusForbidden, "forbidden", "forbidden")
+		return
+	}
+
+	var req LogoutRequest
+	if r.ContentLength != 0 {
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			httpx.Error(w, r, http.StatusBadRequest, "bad_json", "invalid input")
+			return
+		}
+	}
+
+	if err := LogoutSession(claims, req); err != nil {
+		httpx.Error(w, r, http.StatusInternalServerError, "server_error", "failed to logout")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]any{"token": token, "user": user})
+	_ = json.NewEncoder(w).Encode(map[string]any{"message": "logged out"})
+}
+
+func writeTokens(w http.ResponseWriter, pair TokenPair, user User) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"token":         pair.AccessToken,
+		"refresh_token": pair.RefreshToken,
+		"expires_in":    pair.ExpiresIn,
+		"user":          user,
+	})
 }
 
 func toUser(rec UserRecord) User {
@@ -296,6 +542,8 @@ func toUser(rec UserRecord) User {
 		Username:  rec.Username,
 		Role:      rec.Role,
 		Favorites: append([]int(nil), rec.Favorites...),
+		TwoFactor: rec.TOTPEnabled,
+		Disabled:  rec.Disabled,
 		CreatedAt: rec.CreatedAt.Format(time.RFC3339),
 		UpdatedAt: rec.UpdatedAt.Format(time.RFC3339),
 	}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"AdvancedProgramming/internal/httpx"
+)
+
+// errorCodes gives the API code of each error a handler may pass through to
+// the client. Clients match on these, so they must not change.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrInvalidCredentials, "invalid_credentials"},
+	{ErrInvalidAdminKey, "invalid_admin_key"},
+	{ErrUserExists, "user_exists"},
+	{ErrUserNotFound, "user_not_found"},
+	{ErrInvalidCarID, "bad_id"},
+	{ErrInvalidCursor, "bad_query"},
+	{ErrInvalidRole, "invalid_role"},
+	{ErrEmptyUsername, "empty_username"},
+	{ErrSelfModify, "self_modify"},
+	{ErrRefreshInvalid, "invalid_refresh_token"},
+	{ErrRefreshReused, "refresh_token_reused"},
+	{ErrTokenRevoked, "token_revoked"},
+	{ErrAccountDisabled, "account_disabled"},
+	{ErrMFAAlreadyEnabled, "mfa_already_enabled"},
+	{ErrMFANotEnabled, "mfa_not_enabled"},
+	{ErrMFANotSetUp, "mfa_not_set_up"},
+	{ErrInvalidMFACode, "invalid_mfa_code"},
+	{ErrMFARequired, "mfa_required"},
+	{ErrInvalidMFAToken, "invalid_mfa_token"},
+	{ErrWrongPassword, "wrong_password"},
+	{ErrResetInvalid, "invalid_reset_token"},
+	{ErrNoSigningKey, "signing_key_unavailable"},
+	{errConcurrentUpdate, "conflict"},
+}
+
+// writeError sends err with its registered code, or the generic code for
+// status. Server errors are logged and their text is not shown.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if status >= http.StatusInternalServerError {
+		log.Printf("[AUTH] %s %s: %v", r.Method, r.URL.Path, err)
+		httpx.Error(w, r, status, httpx.CodeForStatus(status), "Internal server error")
+		return
+	}
+
+	var verr *httpx.ValidationError
+	if errors.As(err, &verr) {
+		httpx.WriteError(w, r, status, httpx.Err("validation_error", verr.Error()).WithDetails(verr.Fields...))
+		return
+	}
+
+	code := httpx.CodeForStatus(status)
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			code = c.code
+			break
+		}
+	}
+	httpx.Error(w, r, status, code, err.Error())
+}
+
+// writeRequired rejects a body that is missing fields.
+func writeRequired(w http.ResponseWriter, r *http.Request, message string, fields ...string) {
+	details := make([]httpx.FieldError, 0, len(fields))
+	for _, f := range fields {
+		details = append(details, httpx.FieldError{Field: f, Code: "required", Message: f + " is required"})
+	}
+	httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("validation_error", message).WithDetails(details...))
+}
@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"AdvancedProgramming/internal/httpx"
+)
+
+// devSecret is only accepted when APP_ENV=dev.
+const devSecret = "my_secret_key_2026"
+
+var ErrNoSigningKey = errors.New("jwt signing keys not configured")
+
+// SigningKey is one key tokens can be signed or verified with. Private is
+// nil for keys that are only accepted for verification, e.g. a key that was
+// rotated out but whose tokens have not expired yet.
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private any
+	Public  any
+}
+
+// KeySet holds the key new tokens are signed with and every key tokens are
+// still accepted from, selected by the kid header.
+//
+// MFA challenges are signed with a separate HMAC key that never leaves this
+// server, so services verifying access tokens through JWKS or a shared
+// JWT_SECRET can never mistake a challenge for a login.
+type KeySet struct {
+	signing      SigningKey
+	byID         map[string]SigningKey
+	challengeKey []byte
+}
+
+// NewKeySet creates a key set with a random challenge key. Use
+// SetChallengeKey when several instances must accept each other's challenges.
+func NewKeySet(signing SigningKey, verifyOnly ...SigningKey) (*KeySet, error) {
+	if signing.ID == "" || signing.Private == nil {
+		return nil, errors.New("signing key needs an id and a private key")
+	}
+	challengeKey := make([]byte, 32)
+	if _, err := rand.Read(challengeKey); err != nil {
+		return nil, err
+	}
+	ks := &KeySet{signing: signing, byID: map[string]SigningKey{signing.ID: signing}, challengeKey: challengeKey}
+	for _, k := range verifyOnly {
+		if _, dup := ks.byID[k.ID]; dup {
+			return nil, fmt.Errorf("duplicate key id %q", k.ID)
+		}
+		ks.byID[k.ID] = k
+	}
+	return ks, nil
+}
+
+// SetChallengeKey replaces the key MFA challenges are signed with.
+func (ks *KeySet) SetChallengeKey(key []byte) error {
+	if len(key) < 32 {
+		return errors.New("challenge key must be at least 32 bytes")
+	}
+	ks.challengeKey = key
+	return nil
+}
+
+var (
+	keySetMu sync.RWMutex
+	keySet   *KeySet
+)
+
+// SetKeySet replaces the keys used by GenerateJWT and ValidateToken.
+func SetKeySet(ks *KeySet) {
+	keySetMu.Lock()
+	keySet = ks
+	keySetMu.Unlock()
+}
+
+func keys() (*KeySet, error) {
+	keySetMu.RLock()
+	defer keySetMu.RUnlock()
+	if keySet == nil {
+		return nil, ErrNoSigningKey
+	}
+	return keySet, nil
+}
+
+// LoadKeySet builds the key set from the environment:
+//
+//	JWT_PRIVATE_KEY_FILE  PEM RSA or Ed25519 private key new tokens are signed with
+//	JWT_PUBLIC_KEY_FILES  comma-separated PEM keys still accepted for verification
+//	JWT_SECRET            HMAC secret; signs tokens when no private key is set
+//	MFA_CHALLENGE_SECRET  HMAC secret for MFA challenges, at least 32 bytes;
+//	                      random per process when unset
+//
+// The kid of a key file is its base name without extension. Without any
+// key the built-in secret is used, but only when APP_ENV=dev; setting
+// JWT_SECRET to that value is refused outside dev as well.
+func LoadKeySet() (*KeySet, error) {
+	var (
+		signing    SigningKey
+		verifyOnly []SigningKey
+	)
+
+	dev := strings.EqualFold(os.Getenv("APP_ENV"), "dev")
+	secret := os.Getenv("JWT_SECRET")
+	if secret == devSecret && !dev {
+		return nil, errors.New("JWT_SECRET is the built-in development secret; set a new one (or APP_ENV=dev)")
+	}
+	if secret == "" && dev {
+		log.Printf("[AUTH] WARNING: using the built-in JWT secret, never do this in production")
+		secret = devSecret
+	}
+	var hmacKey *SigningKey
+	if secret != "" {
+		hmacKey = &SigningKey{ID: "hs256", Method: jwt.SigningMethodHS256, Private: []byte(secret), Public: []byte(secret)}
+	}
+
+	if path := os.Getenv("JWT_PRIVATE_KEY_FILE"); path != "" {
+		k, err := loadKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if k.Private == nil {
+			return nil, fmt.Errorf("%s: not a private key", path)
+		}
+		signing = k
+		if hmacKey != nil {
+			verifyOnly = append(verifyOnly, *hmacKey)
+		}
+	} else if hmacKey != nil {
+		signing = *hmacKey
+	} else {
+		return nil, errors.New("JWT_SECRET or JWT_PRIVATE_KEY_FILE must be set (or APP_ENV=dev)")
+	}
+
+	for _, path := range strings.Split(os.Getenv("JWT_PUBLIC_KEY_FILES"), ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		k, err := loadKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		k.Private = nil
+		verifyOnly = append(verifyOnly, k)
+	}
+
+	ks, err := NewKeySet(signing, verifyOnly...)
+	if err != nil {
+		return nil, err
+	}
+	if secret := os.Getenv("MFA_CHALLENGE_SECRET"); secret != "" {
+		if err := ks.SetChallengeKey([]byte(secret)); err != nil {
+			return nil, fmt.Errorf("MFA_CHALLENGE_SECRET: %w", err)
+		}
+	}
+	return ks, nil
+}
+
+func loadKeyFile(path string) (SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return SigningKey{}, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	id := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	key := SigningKey{ID: id}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodEdDSA, k
+	default:
+		return SigningKey{}, fmt.Errorf("%s: only RSA and Ed25519 keys are supported", path)
+	}
+	if pub, ok := key.Public.(*rsa.PublicKey); ok && pub.N.BitLen() < 2048 {
+		return SigningKey{}, fmt.Errorf("%s: RSA keys must be at least 2048 bits", path)
+	}
+	return key, nil
+}
+
+func (ks *KeySet) sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(ks.signing.Method, claims)
+	token.Header["kid"] = ks.signing.ID
+	return token.SignedString(ks.signing.Private)
+}
+
+// signChallenge signs an MFA challenge with the server-only challenge key.
+func (ks *KeySet) signChallenge(claims jwt.MapClaims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ks.challengeKey)
+}
+
+// parseChallenge only accepts tokens signed with the challenge key.
+func (ks *KeySet) parseChallenge(signed string) (*jwt.Token, error) {
+	return jwt.Parse(signed, func(*jwt.Token) (any, error) {
+		return ks.challengeKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+}
+
+// keyFunc picks the verification key by kid and rejects tokens whose alg
+// does not match that key. Tokens without a kid were issued before key
+// rotation and are only checked against the HMAC secret.
+func (ks *KeySet) keyFunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = "hs256"
+	}
+	k, ok := ks.byID[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != k.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return k.Public, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// jwks lists the public keys; HMAC secrets are never published.
+func (ks *KeySet) jwks() []jwk {
+	out := make([]jwk, 0, len(ks.byID))
+	for _, k := range ks.byID {
+		switch pub := k.Public.(type) {
+		case *rsa.PublicKey:
+			out = append(out, jwk{
+				Kty: "RSA", Kid: k.ID, Alg: k.Method.Alg(), Use: "sig",
+				N: b64(pub.N.Bytes()),
+				E: b64(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			out = append(out, jwk{Kty: "OKP", Kid: k.ID, Alg: k.Method.Alg(), Use: "sig", Crv: "Ed25519", X: b64(pub)})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Kid < out[j].Kid })
+	return out
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// JWKS serves the public verification keys so other services can check
+// Car Store tokens without sharing a secret.
+func JWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	ks, err := keys()
+	if err != nil {
+		writeError(w, r, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	_ = json.NewEncoder(w).Encode(map[string]any{"keys": ks.jwks()})
+}
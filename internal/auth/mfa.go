@@ -0,0 +1,538 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"AdvancedProgramming/internal/httpx"
+)
+
+// RFC 6238 parameters every authenticator app understands.
+const (
+	totpIssuer = "CarStore"
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew accepts codes from one period before and after now to allow
+	// for clock drift between server and phone.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	mfaChallengeTTL   = 5 * time.Minute
+)
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrMFANotSetUp       = errors.New("call /auth/2fa/setup first")
+	ErrInvalidMFACode    = errors.New("invalid two-factor code")
+	ErrMFARequired       = errors.New("two-factor authentication required")
+	ErrInvalidMFAToken   = errors.New("invalid mfa token")
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// MFARequiredError is returned by LoginUser when the password was right but
+// the user has TOTP enabled. Token is exchanged at /auth/login/2fa together
+// with a code.
+type MFARequiredError struct {
+	Token string
+}
+
+func (e *MFARequiredError) Error() string { return "two-factor code required" }
+
+type MFACodeRequest struct {
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+type MFALoginRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+type DisableMFARequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+var requireAdminMFA atomic.Bool
+
+// SetRequireAdminMFA makes RequireRoles turn away admins whose session did
+// not pass a second factor. They can still reach /auth/2fa to enroll.
+func SetRequireAdminMFA(on bool) { requireAdminMFA.Store(on) }
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	off := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, bin%1000000)
+}
+
+// verifyTOTP returns the time step code matched. Steps up to lastStep were
+// used before and are rejected so a code cannot be replayed.
+func verifyTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := b32.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func otpauthURI(username, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + q.Encode()
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// newRecoveryCodes returns codes to show once and the hashes to store.
+func newRecoveryCodes() ([]string, []string) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		_, _ = rand.Read(b)
+		raw := strings.ToLower(b32.EncodeToString(b))
+		codes[i] = raw[:4] + "-" + raw[4:]
+		hashes[i] = hashToken(raw)
+	}
+	return codes, hashes
+}
+
+// checkSecondFactor verifies a TOTP code or a recovery code against rec and
+// returns rec with the code consumed. It is meant to run inside
+// users().Update so concurrent uses of one code cannot both pass.
+func checkSecondFactor(rec UserRecord, code, recoveryCode string, now time.Time) (UserRecord, error) {
+	if !rec.TOTPEnabled {
+		return rec, ErrMFANotEnabled
+	}
+	if code != "" {
+		step, ok := verifyTOTP(rec.TOTPSecret, code, now, rec.TOTPLastStep)
+		if !ok {
+			return rec, ErrInvalidMFACode
+		}
+		rec.TOTPLastStep = step
+		return rec, nil
+	}
+	if recoveryCode != "" {
+		hash := hashToken(normalizeRecoveryCode(recoveryCode))
+		for i, h := range rec.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				rest := make([]string, 0, len(rec.RecoveryCodes)-1)
+				rest = append(rest, rec.RecoveryCodes[:i]...)
+				rec.RecoveryCodes = append(rest, rec.RecoveryCodes[i+1:]...)
+				return rec, nil
+			}
+		}
+	}
+	return rec, ErrInvalidMFACode
+}
+
+// SetupTOTP generates a new secret for the user. It only takes effect once
+// EnableTOTP confirms the authenticator app produces matching codes.
+func SetupTOTP(username string) (secret, uri string, err error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", err
+	}
+	secret = b32.EncodeToString(key)
+
+	_, err = users().Update(username, func(rec UserRecord) (UserRecord, error) {
+		if rec.TOTPEnabled {
+			return rec, ErrMFAAlreadyEnabled
+		}
+		rec.TOTPPending = secret
+		rec.UpdatedAt = time.Now().UTC()
+		return rec, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return secret, otpauthURI(username, secret), nil
+}
+
+// EnableTOTP turns on 2FA once code matches the pending secret. It returns
+// the recovery codes, which are never shown again, and a pair of tokens
+// that count as having passed the second factor.
+func EnableTOTP(username, code string) ([]string, TokenPair, User, error) {
+	codes, hashes := newRecoveryCodes()
+	now := time.Now()
+
+	rec, err := users().Update(username, func(rec UserRecord) (UserRecord, error) {
+		if rec.TOTPEnabled {
+			return rec, ErrMFAAlreadyEnabled
+		}
+		if rec.TOTPPending == "" {
+			return rec, ErrMFANotSetUp
+		}
+		step, ok := verifyTOTP(rec.TOTPPending, code, now, 0)
+		if !ok {
+			return rec, ErrInvalidMFACode
+		}
+		rec.TOTPEnabled = true
+		rec.TOTPSecret = rec.TOTPPending
+		rec.TOTPPending = ""
+		rec.TOTPLastStep = step
+		rec.RecoveryCodes = hashes
+		rec.UpdatedAt = now.UTC()
+		return rec, nil
+	})
+	if err != nil {
+		return nil, TokenPair{}, User{}, err
+	}
+
+	log.Printf("[AUTH] two-factor authentication enabled for %s", username)
+	pair, err := issueTokens(rec, "", true)
+	if err != nil {
+		return nil, TokenPair{}, User{}, errors.New("failed to generate token")
+	}
+	return codes, pair, toUser(rec), nil
+}
+
+// DisableTOTP turns 2FA off after checking the password and a second factor.
+func DisableTOTP(username string, req DisableMFARequest) error {
+	rec, err := users().GetByUsername(username)
+	if err != nil {
+		return err
+	}
+	if !CheckPasswordHash(strings.TrimSpace(req.Password), rec.PasswordHash) {
+		return ErrWrongPassword
+	}
+
+	now := time.Now()
+	_, err = users().Update(username, func(rec UserRecord) (UserRecord, error) {
+		rec, err := checkSecondFactor(rec, req.Code, req.RecoveryCode, now)
+		if err != nil {
+			return rec, err
+		}
+		rec.TOTPEnabled = false
+		rec.TOTPSecret = ""
+		rec.TOTPPending = ""
+		rec.TOTPLastStep = 0
+		rec.RecoveryCodes = nil
+		rec.UpdatedAt = now.UTC()
+		return rec, nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[AUTH] two-factor authentication disabled for %s", username)
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after a TOTP check.
+func RegenerateRecoveryCodes(username, code string) ([]string, error) {
+	codes, hashes := newRecoveryCodes()
+	now := time.Now()
+
+	_, err := users().Update(username, func(rec UserRecord) (UserRecord, error) {
+		rec, err := checkSecondFactor(rec, code, "", now)
+		if err != nil {
+			return rec, err
+		}
+		rec.RecoveryCodes = hashes
+		rec.UpdatedAt = now.UTC()
+		return rec, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// mfaChallenge signs a short-lived token proving the password step passed.
+// It uses the challenge key, not the access token key, so nothing that
+// verifies access tokens accepts it; ValidateToken also rejects its typ.
+func mfaChallenge(rec UserRecord) (string, error) {
+	ks, err := keys()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return ks.signChallenge(jwt.MapClaims{
+		"typ":      "mfa",
+		"jti":      randomToken(16),
+		"uid":      rec.ID,
+		"username": rec.Username,
+		"ver":      rec.TokenVersion,
+		"exp":      now.Add(mfaChallengeTTL).Unix(),
+		"iat":      now.Unix(),
+	})
+}
+
+func parseMFAChallenge(signed string) (username string, uid, ver int, err error) {
+	ks, err := keys()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	token, err := ks.parseChallenge(signed)
+	if err != nil {
+		return "", 0, 0, ErrInvalidMFAToken
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || claims["typ"] != "mfa" {
+		return "", 0, 0, ErrInvalidMFAToken
+	}
+	username, _ = claims["username"].(string)
+	uidF, _ := claims["uid"].(float64)
+	verF, _ := claims["ver"].(float64)
+	if username == "" || uidF <= 0 {
+		return "", 0, 0, ErrInvalidMFAToken
+	}
+	return username, int(uidF), int(verF), nil
+}
+
+// CompleteMFALogin finishes a login that LoginUser answered with
+// MFARequiredError. Wrong codes count as failed logins for throttling.
+func CompleteMFALogin(req MFALoginRequest, ip string) (TokenPair, User, error) {
+	username, uid, ver, err := parseMFAChallenge(strings.TrimSpace(req.MFAToken))
+	if err != nil {
+		return TokenPair{}, User{}, err
+	}
+	if strings.TrimSpace(req.Code) == "" && strings.TrimSpace(req.RecoveryCode) == "" {
+		return TokenPair{}, User{}, errors.New("code or recovery_code required")
+	}
+
+	checks := loginChecks(username, ip)
+	release, err := beginLogin(checks, time.Now())
+	if err != nil {
+		return TokenPair{}, User{}, err
+	}
+	defer release()
+
+	now := time.Now()
+	rec, err := users().Update(username, func(rec UserRecord) (UserRecord, error) {
+		if rec.ID != uid || rec.TokenVersion != ver {
+			return rec, ErrInvalidMFAToken
+		}
+		return checkSecondFactor(rec, req.Code, req.RecoveryCode, now)
+	})
+	if errors.Is(err, ErrInvalidMFACode) {
+		recordFailure(checks, time.Now())
+		return TokenPair{}, User{}, err
+	}
+	if err != nil {
+		return TokenPair{}, User{}, err
+	}
+
+	if err := attempts().Reset(userKey(username)); err != nil {
+		log.Printf("[AUTH] failed to reset login attempts for %s: %v", username, err)
+	}
+	if req.RecoveryCode != "" {
+		log.Printf("[AUTH] %s logged in with a recovery code, %d left", username, len(rec.RecoveryCodes))
+	}
+
+	pair, err := issueTokens(rec, "", true)
+	if err != nil {
+		return TokenPair{}, User{}, errors.New("failed to generate token")
+	}
+	return pair, toUser(rec), nil
+}
+
+func mfaStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidMFACode), errors.Is(err, ErrWrongPassword):
+		return http.StatusForbidden
+	case errors.Is(err, ErrMFAAlreadyEnabled), errors.Is(err, ErrMFANotEnabled):
+		return http.StatusConflict
+	case errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// SetupMFA must run behind AuthMiddleware.
+func SetupMFA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	username, ok := UsernameFromContext(r.Context())
+	if !ok {
+		httpx.Error(w, r, http.StatusForbidden, "forbidden", "forbidden")
+		return
+	}
+
+	secret, uri, err := SetupTOTP(username)
+	if err != nil {
+		writeError(w, r, mfaStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"secret":      secret,
+		"otpauth_uri": uri,
+	})
+}
+
+// EnableMFA must run behind AuthMiddleware.
+func EnableMFA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	username, ok := UsernameFromContext(r.Context())
+	if !ok {
+		httpx.Error(w, r, http.StatusForbidden, "forbidden", "forbidden")
+		return
+	}
+
+	var req MFACodeRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil || strings.TrimSpace(req.Code) == "" {
+		writeRequired(w, r, "code required", "code")
+		return
+	}
+
+	codes, pair, user, err := EnableTOTP(username, req.Code)
+	if err != nil {
+		writeError(w, r, mfaStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"recovery_codes": codes,
+		"token":          pair.AccessToken,
+		"refresh_token":  pair.RefreshToken,
+		"expires_in":     pair.ExpiresIn,
+		"user":           user,
+	})
+}
+
+// DisableMFA must run behind AuthMiddleware.
+func DisableMFA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	username, ok := UsernameFromContext(r.Context())
+	if !ok {
+		httpx.Error(w, r, http.StatusForbidden, "forbidden", "forbidden")
+		return
+	}
+
+	var req DisableMFARequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		httpx.Error(w, r, http.StatusBadRequest, "bad_json", "invalid input")
+		return
+	}
+
+	if err := DisableTOTP(username, req); err != nil {
+		writeError(w, r, mfaStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"message": "two-factor authentication disabled"})
+}
+
+// RecoveryCodes must run behind AuthMiddleware.
+func RecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	username, ok := UsernameFromContext(r.Context())
+	if !ok {
+		httpx.Error(w, r, http.StatusForbidden, "forbidden", "forbidden")
+		return
+	}
+
+	var req MFACodeRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil || strings.TrimSpace(req.Code) == "" {
+		writeRequired(w, r, "code required", "code")
+		return
+	}
+
+	codes, err := RegenerateRecoveryCodes(username, req.Code)
+	if err != nil {
+		writeError(w, r, mfaStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"recovery_codes": codes})
+}
+
+func LoginMFA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	var req MFALoginRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		httpx.Error(w, r, http.StatusBadRequest, "bad_json", "invalid input")
+		return
+	}
+
+	pair, user, err := CompleteMFALogin(req, ClientIP(r))
+	if err != nil {
+		var throttled *TooManyAttemptsError
+		if errors.As(err, &throttled) {
+			writeTooManyAttempts(w, r, throttled)
+			return
+		}
+		writeError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	writeTokens(w, pair, user)
+}
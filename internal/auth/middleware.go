@@ -2,17 +2,34 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
+
+	"AdvancedProgramming/internal/httpx"
 )
 
 type ctxKey string
 
 const (
+	claimsKey   ctxKey = "claims"
+	userIDKey   ctxKey = "user_id"
 	usernameKey ctxKey = "username"
 	roleKey     ctxKey = "role"
 )
 
+func ClaimsFromContext(ctx context.Context) (Claims, bool) {
+	v := ctx.Value(claimsKey)
+	c, ok := v.(Claims)
+	return c, ok
+}
+
+func UserIDFromContext(ctx context.Context) (int, bool) {
+	v := ctx.Value(userIDKey)
+	id, ok := v.(int)
+	return id, ok
+}
+
 func UsernameFromContext(ctx context.Context) (string, bool) {
 	v := ctx.Value(usernameKey)
 	s, ok := v.(string)
@@ -25,27 +42,50 @@ func RoleFromContext(ctx context.Context) (Role, bool) {
 	return r, ok
 }
 
+// Authenticate validates an access token and checks that its session is
+// still live. AuthMiddleware uses it for bearer tokens; the web UI for its
+// session cookie.
+func Authenticate(token string) (Claims, error) {
+	claims, err := ValidateToken(token)
+	if err != nil {
+		return Claims{}, err
+	}
+	if err := checkSession(claims); err != nil {
+		return Claims{}, err
+	}
+	return claims, nil
+}
+
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			http.Error(w, "token required", http.StatusUnauthorized)
+			httpx.Error(w, r, http.StatusUnauthorized, "unauthorized", "token required")
 			return
 		}
 
 		if !strings.HasPrefix(authHeader, "Bearer ") {
-			http.Error(w, "invalid authorization header", http.StatusUnauthorized)
+			httpx.Error(w, r, http.StatusUnauthorized, "unauthorized", "invalid authorization header")
 			return
 		}
 
 		tokenString := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
-		claims, err := ValidateToken(tokenString)
+		claims, err := Authenticate(tokenString)
 		if err != nil {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+			switch {
+			case errors.Is(err, ErrAccountDisabled):
+				writeError(w, r, http.StatusForbidden, err)
+			case errors.Is(err, ErrTokenRevoked):
+				httpx.Error(w, r, http.StatusUnauthorized, "token_revoked", "token revoked")
+			default:
+				httpx.Error(w, r, http.StatusUnauthorized, "invalid_token", "invalid token")
+			}
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), usernameKey, claims.Username)
+		ctx := context.WithValue(r.Context(), claimsKey, claims)
+		ctx = context.WithValue(ctx, userIDKey, claims.UserID)
+		ctx = context.WithValue(ctx, usernameKey, claims.Username)
 		ctx = context.WithValue(ctx, roleKey, claims.Role)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -60,13 +100,19 @@ func RequireRoles(next http.Handler, roles ...Role) http.Handler {
 	return AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		role, ok := RoleFromContext(r.Context())
 		if !ok {
-			http.Error(w, "forbidden", http.StatusForbidden)
+			httpx.Error(w, r, http.StatusForbidden, "forbidden", "forbidden")
 			return
 		}
 		if _, ok := allowed[role]; !ok {
-			http.Error(w, "forbidden", http.StatusForbidden)
+			httpx.Error(w, r, http.StatusForbidden, "forbidden", "forbidden")
 			return
 		}
+		if role == RoleAdmin && requireAdminMFA.Load() {
+			if claims, _ := ClaimsFromContext(r.Context()); !claims.MFA {
+				writeError(w, r, http.StatusForbidden, ErrMFARequired)
+				return
+			}
+		}
 		next.ServeHTTP(w, r)
 	}))
 }
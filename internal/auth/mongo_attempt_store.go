@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoAttemptStore struct {
+	coll *mongo.Collection
+}
+
+func NewMongoAttemptStore(db *mongo.Database) *MongoAttemptStore {
+	s := &MongoAttemptStore{coll: db.Collection("login_attempts")}
+
+	_, err := s.coll.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		log.Printf("auth: failed to create login attempt indexes: %v", err)
+	}
+	return s
+}
+
+func (s *MongoAttemptStore) Get(key string, now time.Time) (LoginAttempts, error) {
+	var a LoginAttempts
+	err := s.coll.FindOne(context.TODO(), bson.M{"key": key, "expires_at": bson.M{"$gt": now}}).Decode(&a)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return LoginAttempts{Key: key}, nil
+	}
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+	return a, nil
+}
+
+func (s *MongoAttemptStore) AddFailure(key string, now time.Time, ttl time.Duration) (LoginAttempts, error) {
+	// one pipeline update, so concurrent failures are all counted; a counter
+	// the TTL monitor has not removed yet starts over
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"key": key,
+		"failures": bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{"$expires_at", now}},
+			bson.M{"$add": bson.A{"$failures", 1}},
+			1,
+		}},
+		"last_failure": now,
+		"expires_at":   now.Add(ttl),
+	}}}}
+
+	var a LoginAttempts
+	err := s.coll.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"key": key},
+		update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&a)
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+	return a, nil
+}
+
+func (s *MongoAttemptStore) Reset(key string) error {
+	_, err := s.coll.DeleteOne(context.TODO(), bson.M{"key": key})
+	return err
+}
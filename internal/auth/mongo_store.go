@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"time"
+
+	"AdvancedProgramming/internal/infrastructure"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const usersCollection = "users"
+
+const maxUpdateRetries = 5
+
+var errConcurrentUpdate = errors.New("user was modified concurrently")
+
+type MongoUserStore struct {
+	coll *mongo.Collection
+}
+
+func NewMongoUserStore(db *mongo.Database) *MongoUserStore {
+	s := &MongoUserStore{coll: db.Collection(usersCollection)}
+	_, err := s.coll.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	if err != nil {
+		log.Printf("auth: failed to create user indexes: %v", err)
+	}
+	return s
+}
+
+func (s *MongoUserStore) Create(rec UserRecord) (UserRecord, error) {
+	if _, err := s.GetByUsername(rec.Username); err == nil {
+		return UserRecord{}, ErrUserExists
+	}
+
+	id, err := infrastructure.NextSequence(context.TODO(), usersCollection)
+	if err != nil {
+		return UserRecord{}, err
+	}
+	rec.ID = id
+
+	if _, err := s.coll.InsertOne(context.TODO(), rec); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return UserRecord{}, ErrUserExists
+		}
+		return UserRecord{}, err
+	}
+	return rec, nil
+}
+
+func (s *MongoUserStore) GetByUsername(username string) (UserRecord, error) {
+	return s.findOne(bson.M{"username": username})
+}
+
+func (s *MongoUserStore) GetByID(id int) (UserRecord, error) {
+	return s.findOne(bson.M{"id": id})
+}
+
+func (s *MongoUserStore) Update(username string, updateFn func(UserRecord) (UserRecord, error)) (UserRecord, error) {
+	for i := 0; i < maxUpdateRetries; i++ {
+		current, err := s.GetByUsername(username)
+		if err != nil {
+			return UserRecord{}, err
+		}
+
+		updated, err := updateFn(current)
+		if err != nil {
+			return UserRecord{}, err
+		}
+
+		// protect system fields
+		updated.ID = current.ID
+		updated.Username = current.Username
+		updated.CreatedAt = current.CreatedAt
+
+		res, err := s.coll.ReplaceOne(context.TODO(), current, updated)
+		if err != nil {
+			return UserRecord{}, err
+		}
+		if res.MatchedCount == 1 {
+			return updated, nil
+		}
+	}
+	return UserRecord{}, errConcurrentUpdate
+}
+
+func (s *MongoUserStore) findOne(filter bson.M) (UserRecord, error) {
+	var rec UserRecord
+	err := s.coll.FindOne(context.TODO(), filter).Decode(&rec)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return UserRecord{}, ErrUserNotFound
+	}
+	if err != nil {
+		return UserRecord{}, err
+	}
+	return rec, nil
+}
+
+func (s *MongoUserStore) List(q UserQuery) (UserPage, error) {
+	after, err := decodeUserCursor(q.Cursor)
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	filter := bson.M{}
+	if q.Search != "" {
+		filter["username"] = bson.M{"$regex": regexp.QuoteMeta(q.Search), "$options": "i"}
+	}
+	if q.Role != "" {
+		filter["role"] = q.Role
+	}
+	if q.Disabled != nil {
+		if *q.Disabled {
+			filter["disabled"] = true
+		} else {
+			filter["disabled"] = bson.M{"$ne": true}
+		}
+	}
+
+	total, err := s.coll.CountDocuments(context.TODO(), filter)
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	filter["id"] = bson.M{"$gt": after}
+	opts := options.Find().SetSort(bson.D{{Key: "id", Value: 1}})
+	if q.Limit > 0 {
+		// one extra document tells whether another page follows
+		opts.SetLimit(int64(q.Limit) + 1)
+	}
+	cur, err := s.coll.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return UserPage{}, err
+	}
+	var items []UserRecord
+	if err := cur.All(context.TODO(), &items); err != nil {
+		return UserPage{}, err
+	}
+
+	page := UserPage{Items: items, Total: int(total)}
+	if q.Limit > 0 && len(items) > q.Limit {
+		page.Items = items[:q.Limit]
+		page.NextCursor = encodeUserCursor(page.Items[q.Limit-1].ID)
+	}
+	return page, nil
+}
+
+func (s *MongoUserStore) Rename(id int, username string) (UserRecord, error) {
+	var rec UserRecord
+	err := s.coll.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"id": id},
+		bson.M{"$set": bson.M{"username": username, "updated_at": time.Now().UTC()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&rec)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return UserRecord{}, ErrUserNotFound
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return UserRecord{}, ErrUserExists
+	}
+	if err != nil {
+		return UserRecord{}, err
+	}
+	return rec, nil
+}
+
+func (s *MongoUserStore) Delete(id int) error {
+	res, err := s.coll.DeleteOne(context.TODO(), bson.M{"id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *MongoUserStore) PullFavorite(carID int) error {
+	_, err := s.coll.UpdateMany(
+		context.TODO(),
+		bson.M{"favorites": carID},
+		bson.M{
+			"$pull": bson.M{"favorites": carID},
+			"$set":  bson.M{"updated_at": time.Now().UTC()},
+		},
+	)
+	return err
+}
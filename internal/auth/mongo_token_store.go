@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoTokenStore struct {
+	refresh *mongo.Collection
+	revoked *mongo.Collection
+	resets  *mongo.Collection
+}
+
+func NewMongoTokenStore(db *mongo.Database) *MongoTokenStore {
+	s := &MongoTokenStore{
+		refresh: db.Collection("refresh_tokens"),
+		revoked: db.Collection("revoked_tokens"),
+		resets:  db.Collection("password_resets"),
+	}
+
+	// expired documents are removed by MongoDB's TTL monitor
+	_, err := s.refresh.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "family", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		log.Printf("auth: failed to create refresh token indexes: %v", err)
+	}
+	_, err = s.revoked.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "jti", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		log.Printf("auth: failed to create revoked token indexes: %v", err)
+	}
+	_, err = s.resets.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		log.Printf("auth: failed to create password reset indexes: %v", err)
+	}
+	return s
+}
+
+func (s *MongoTokenStore) SaveRefresh(rec RefreshToken) error {
+	_, err := s.refresh.InsertOne(context.TODO(), rec)
+	return err
+}
+
+func (s *MongoTokenStore) UseRefresh(hash string, now time.Time) (RefreshToken, error) {
+	var rec RefreshToken
+	err := s.refresh.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"hash": hash, "used_at": nil, "revoked": false, "expires_at": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"used_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&rec)
+	if err == nil {
+		return rec, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return RefreshToken{}, err
+	}
+
+	// tell a replayed token apart from an unknown one
+	err = s.refresh.FindOne(context.TODO(), bson.M{"hash": hash}).Decode(&rec)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return RefreshToken{}, ErrRefreshInvalid
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if rec.UsedAt != nil && !rec.Revoked && now.Before(rec.ExpiresAt) {
+		return rec, ErrRefreshReused
+	}
+	return RefreshToken{}, ErrRefreshInvalid
+}
+
+func (s *MongoTokenStore) RevokeFamily(family string) error {
+	_, err := s.refresh.UpdateMany(
+		context.TODO(),
+		bson.M{"family": family},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	return err
+}
+
+func (s *MongoTokenStore) RevokeAccess(jti string, expiresAt time.Time) error {
+	_, err := s.revoked.UpdateOne(
+		context.TODO(),
+		bson.M{"jti": jti},
+		bson.M{"$set": bson.M{"jti": jti, "expires_at": expiresAt}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *MongoTokenStore) IsAccessRevoked(jti string) (bool, error) {
+	n, err := s.revoked.CountDocuments(context.TODO(), bson.M{"jti": jti}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (s *MongoTokenStore) SaveReset(rec ResetToken) error {
+	_, err := s.resets.InsertOne(context.TODO(), rec)
+	return err
+}
+
+func (s *MongoTokenStore) UseReset(hash string, now time.Time) (ResetToken, error) {
+	var rec ResetToken
+	err := s.resets.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"hash": hash, "used_at": nil, "expires_at": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"used_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&rec)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ResetToken{}, ErrResetInvalid
+	}
+	if err != nil {
+		return ResetToken{}, err
+	}
+	return rec, nil
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Message is something the service needs to tell a user out of band, such
+// as a password reset token.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers messages to users. Production deployments plug in an
+// email or SMS sender; LogNotifier and FileNotifier are for local
+// development.
+type Notifier interface {
+	Notify(msg Message) error
+}
+
+var (
+	notifierMu sync.RWMutex
+	notifier   Notifier = LogNotifier{}
+)
+
+// NewNotifier writes messages to NOTIFY_FILE when it is set and to the log
+// otherwise.
+func NewNotifier() Notifier {
+	if path := os.Getenv("NOTIFY_FILE"); path != "" {
+		return &FileNotifier{Path: path}
+	}
+	return LogNotifier{}
+}
+
+// SetNotifier replaces the notifier used by the password reset flow.
+func SetNotifier(n Notifier) {
+	notifierMu.Lock()
+	notifier = n
+	notifierMu.Unlock()
+}
+
+func notify() Notifier {
+	notifierMu.RLock()
+	defer notifierMu.RUnlock()
+	return notifier
+}
+
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(msg Message) error {
+	log.Printf("[NOTIFY] to=%s subject=%q\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// FileNotifier appends every message to a file.
+type FileNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (n *FileNotifier) Notify(msg Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "--- %s\nTo: %s\nSubject: %s\n\n%s\n\n",
+		time.Now().UTC().Format(time.RFC3339), msg.To, msg.Subject, msg.Body)
+	return err
+}
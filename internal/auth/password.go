@@ -0,0 +1,277 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"AdvancedProgramming/internal/httpx"
+)
+
+const resetTokenTTL = time.Hour
+
+var (
+	ErrWrongPassword = errors.New("current password is incorrect")
+	ErrResetInvalid  = errors.New("invalid or expired reset token")
+)
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type ForgotPasswordRequest struct {
+	Username string `json:"username"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// ResetToken is the stored form of a password reset token. Like refresh
+// tokens only the hash is kept. TokenVersion ties it to the password it was
+// requested for, so a later password change voids it.
+type ResetToken struct {
+	Hash         string     `bson:"hash"`
+	UserID       int        `bson:"user_id"`
+	Username     string     `bson:"username"`
+	TokenVersion int        `bson:"token_version"`
+	ExpiresAt    time.Time  `bson:"expires_at"`
+	UsedAt       *time.Time `bson:"used_at"`
+	CreatedAt    time.Time  `bson:"created_at"`
+}
+
+// ChangePassword sets a new password after checking the current one and
+// signs the user out everywhere. The returned pair replaces the caller's
+// now invalid tokens.
+func ChangePassword(claims Claims, req ChangePasswordRequest) (TokenPair, User, error) {
+	username := claims.Username
+	current := strings.TrimSpace(req.CurrentPassword)
+	next := strings.TrimSpace(req.NewPassword)
+	if current == "" || next == "" {
+		return TokenPair{}, User{}, errors.New("current_password and new_password required")
+	}
+
+	rec, err := users().GetByUsername(username)
+	if err != nil {
+		return TokenPair{}, User{}, err
+	}
+	if !CheckPasswordHash(current, rec.PasswordHash) {
+		return TokenPair{}, User{}, ErrWrongPassword
+	}
+
+	rec, err = setPassword(username, rec.TokenVersion, next)
+	if err != nil {
+		return TokenPair{}, User{}, err
+	}
+
+	pair, err := issueTokens(rec, "", claims.MFA)
+	if err != nil {
+		return TokenPair{}, User{}, errors.New("failed to generate token")
+	}
+	return pair, toUser(rec), nil
+}
+
+// RequestPasswordReset sends a single-use reset token through the notifier.
+// Unknown usernames are silently ignored so the endpoint cannot be used to
+// probe for accounts.
+func RequestPasswordReset(username string) error {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return errors.New("username required")
+	}
+
+	rec, err := users().GetByUsername(username)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token := randomToken(32)
+	now := time.Now().UTC()
+	err = tokens().SaveReset(ResetToken{
+		Hash:         hashToken(token),
+		UserID:       rec.ID,
+		Username:     rec.Username,
+		TokenVersion: rec.TokenVersion,
+		ExpiresAt:    now.Add(resetTokenTTL),
+		CreatedAt:    now,
+	})
+	if err != nil {
+		return err
+	}
+
+	return notify().Notify(Message{
+		To:      rec.Username,
+		Subject: "Car Store password reset",
+		Body: fmt.Sprintf("Use this token to reset your password within %s:\n\n%s\n\n"+
+			"POST /auth/password/reset {\"token\": \"...\", \"new_password\": \"...\"}\n\n"+
+			"If you did not ask for a reset, ignore this message.", resetTokenTTL, token),
+	})
+}
+
+// ResetPassword consumes a reset token and sets the new password. All
+// existing sessions of the user are invalidated.
+func ResetPassword(req ResetPasswordRequest) error {
+	token := strings.TrimSpace(req.Token)
+	next := strings.TrimSpace(req.NewPassword)
+	if token == "" || next == "" {
+		return errors.New("token and new_password required")
+	}
+
+	rt, err := tokens().UseReset(hashToken(token), time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	rec, err := users().GetByUsername(rt.Username)
+	if err != nil || rec.ID != rt.UserID {
+		return ErrResetInvalid
+	}
+
+	_, err = setPassword(rec.Username, rt.TokenVersion, next)
+	return err
+}
+
+// setPassword stores a new password hash and bumps the token version, which
+// invalidates every access, refresh and reset token issued so far. It fails
+// with ErrResetInvalid if the version moved since the caller read it.
+func setPassword(username string, version int, password string) (UserRecord, error) {
+	hashed, err := HashPassword(password)
+	if err != nil {
+		return UserRecord{}, errors.New("failed to hash password")
+	}
+
+	rec, err := users().Update(username, func(rec UserRecord) (UserRecord, error) {
+		if rec.TokenVersion != version {
+			return rec, ErrResetInvalid
+		}
+		rec.PasswordHash = hashed
+		rec.TokenVersion++
+		rec.UpdatedAt = time.Now().UTC()
+		return rec, nil
+	})
+	if err != nil {
+		return UserRecord{}, err
+	}
+
+	log.Printf("[AUTH] password changed for user %s", username)
+	return rec, nil
+}
+
+// ChangePasswordHandler must run behind AuthMiddleware.
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		httpx.Error(w, r, http.StatusForbidden, "forbidden", "forbidden")
+		return
+	}
+
+	var req ChangePasswordRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		httpx.Error(w, r, http.StatusBadRequest, "bad_json", "invalid input")
+		return
+	}
+
+	pair, user, err := ChangePassword(claims, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrWrongPassword):
+			writeError(w, r, http.StatusForbidden, err)
+		case errors.Is(err, ErrResetInvalid):
+			httpx.Error(w, r, http.StatusConflict, "conflict", "password was changed concurrently, try again")
+		case errors.Is(err, ErrUserNotFound):
+			httpx.Error(w, r, http.StatusNotFound, "user_not_found", "user not found")
+		default:
+			writeError(w, r, http.StatusBadRequest, err)
+		}
+		return
+	}
+
+	writeTokens(w, pair, user)
+}
+
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	var req ForgotPasswordRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		httpx.Error(w, r, http.StatusBadRequest, "bad_json", "invalid input")
+		return
+	}
+
+	if strings.TrimSpace(req.Username) == "" {
+		writeRequired(w, r, "username required", "username")
+		return
+	}
+
+	if err := RequestPasswordReset(req.Username); err != nil {
+		log.Printf("[AUTH] password reset request failed: %v", err)
+		httpx.Error(w, r, http.StatusInternalServerError, "server_error", "failed to send reset token")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"message": "if the account exists, a reset token has been sent",
+	})
+}
+
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	var req ResetPasswordRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		httpx.Error(w, r, http.StatusBadRequest, "bad_json", "invalid input")
+		return
+	}
+
+	var missing []string
+	if strings.TrimSpace(req.Token) == "" {
+		missing = append(missing, "token")
+	}
+	if strings.TrimSpace(req.NewPassword) == "" {
+		missing = append(missing, "new_password")
+	}
+	if len(missing) > 0 {
+		writeRequired(w, r, "token and new_password required", missing...)
+		return
+	}
+
+	if err := ResetPassword(req); err != nil {
+		if errors.Is(err, ErrResetInvalid) {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		httpx.Error(w, r, http.StatusInternalServerError, "server_error", "failed to reset password")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"message": "password has been reset"})
+}
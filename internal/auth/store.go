@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"AdvancedProgramming/internal/infrastructure"
+)
+
+var (
+	ErrUserExists    = errors.New("user already exists")
+	ErrUserNotFound  = errors.New("user not found")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// UserQuery filters and pages user listings. Search matches a
+// case-insensitive substring of the username; Disabled is ignored when nil.
+// Results are ordered by ID; a zero Limit returns every match.
+type UserQuery struct {
+	Search   string
+	Role     Role
+	Disabled *bool
+
+	Limit  int
+	Cursor string
+}
+
+// UserPage is one page of users plus the total number of matches.
+// NextCursor is empty on the last page.
+type UserPage struct {
+	Items      []UserRecord
+	Total      int
+	NextCursor string
+}
+
+func encodeUserCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+
+func decodeUserCursor(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	id, err := strconv.Atoi(string(b))
+	if err != nil || id < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return id, nil
+}
+
+// UserStore persists user records. Create assigns the ID and must reject a
+// duplicate username with ErrUserExists; lookups return ErrUserNotFound.
+// Rename is the only way to change a username and also fails with
+// ErrUserExists when the new name is taken. PullFavorite removes a car from
+// every user's favorites.
+type UserStore interface {
+	Create(rec UserRecord) (UserRecord, error)
+	GetByUsername(username string) (UserRecord, error)
+	GetByID(id int) (UserRecord, error)
+	Update(username string, updateFn func(UserRecord) (UserRecord, error)) (UserRecord, error)
+	List(q UserQuery) (UserPage, error)
+	Rename(id int, username string) (UserRecord, error)
+	Delete(id int) error
+	PullFavorite(carID int) error
+}
+
+var (
+	storeMu sync.RWMutex
+	store   UserStore = NewMemoryUserStore()
+)
+
+// NewUserStore picks MongoDB when infrastructure.InitDatabase has connected
+// and falls back to memory otherwise.
+func NewUserStore() UserStore {
+	if infrastructure.Database == nil {
+		return NewMemoryUserStore()
+	}
+	return NewMongoUserStore(infrastructure.Database)
+}
+
+// SetUserStore replaces the store used by the package-level auth functions.
+func SetUserStore(s UserStore) {
+	storeMu.Lock()
+	store = s
+	storeMu.Unlock()
+}
+
+func users() UserStore {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return store
+}
+
+type MemoryUserStore struct {
+	mu     sync.RWMutex
+	nextID int
+	items  map[string]UserRecord // username -> record
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{items: make(map[string]UserRecord)}
+}
+
+func (s *MemoryUserStore) Create(rec UserRecord) (UserRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.items[rec.Username]; exists {
+		return UserRecord{}, ErrUserExists
+	}
+	s.nextID++
+	rec.ID = s.nextID
+	s.items[rec.Username] = rec
+	return rec, nil
+}
+
+func (s *MemoryUserStore) GetByUsername(username string) (UserRecord, error) {
+	s.mu.RLock()
+	rec, ok := s.items[username]
+	s.mu.RUnlock()
+	if !ok {
+		return UserRecord{}, ErrUserNotFound
+	}
+	return rec, nil
+}
+
+func (s *MemoryUserStore) GetByID(id int) (UserRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, rec := range s.items {
+		if rec.ID == id {
+			return rec, nil
+		}
+	}
+	return UserRecord{}, ErrUserNotFound
+}
+
+func (s *MemoryUserStore) Update(username string, updateFn func(UserRecord) (UserRecord, error)) (UserRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.items[username]
+	if !ok {
+		return UserRecord{}, ErrUserNotFound
+	}
+	updated, err := updateFn(current)
+	if err != nil {
+		return UserRecord{}, err
+	}
+	// protect system fields
+	updated.ID = current.ID
+	updated.Username = current.Username
+	updated.CreatedAt = current.CreatedAt
+	s.items[username] = updated
+	return updated, nil
+}
+
+func (s *MemoryUserStore) List(q UserQuery) (UserPage, error) {
+	after, err := decodeUserCursor(q.Cursor)
+	if err != nil {
+		return UserPage{}, err
+	}
+	search := strings.ToLower(q.Search)
+
+	s.mu.RLock()
+	matches := make([]UserRecord, 0, len(s.items))
+	for _, rec := range s.items {
+		if search != "" && !strings.Contains(strings.ToLower(rec.Username), search) {
+			continue
+		}
+		if q.Role != "" && rec.Role != q.Role {
+			continue
+		}
+		if q.Disabled != nil && rec.Disabled != *q.Disabled {
+			continue
+		}
+		matches = append(matches, rec)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+	page := UserPage{Total: len(matches)}
+	for _, rec := range matches {
+		if rec.ID <= after {
+			continue
+		}
+		if q.Limit > 0 && len(page.Items) == q.Limit {
+			page.NextCursor = encodeUserCursor(page.Items[len(page.Items)-1].ID)
+			break
+		}
+		page.Items = append(page.Items, rec)
+	}
+	return page, nil
+}
+
+func (s *MemoryUserStore) Rename(id int, username string) (UserRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, taken := s.items[username]; taken {
+		return UserRecord{}, ErrUserExists
+	}
+	for old, rec := range s.items {
+		if rec.ID == id {
+			delete(s.items, old)
+			rec.Username = username
+			rec.UpdatedAt = time.Now().UTC()
+			s.items[username] = rec
+			return rec, nil
+		}
+	}
+	return UserRecord{}, ErrUserNotFound
+}
+
+func (s *MemoryUserStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, rec := range s.items {
+		if rec.ID == id {
+			delete(s.items, name)
+			return nil
+		}
+	}
+	return ErrUserNotFound
+}
+
+func (s *MemoryUserStore) PullFavorite(carID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, rec := range s.items {
+		if !slices.Contains(rec.Favorites, carID) {
+			continue
+		}
+		rec.Favorites = slices.DeleteFunc(slices.Clone(rec.Favorites), func(id int) bool { return id == carID })
+		rec.UpdatedAt = time.Now().UTC()
+		s.items[name] = rec
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"AdvancedProgramming/internal/httpx"
+	"AdvancedProgramming/internal/infrastructure"
+)
+
+// LoginAttempts counts consecutive failed logins for one key, either a
+// username or a client IP. The counter is forgotten at ExpiresAt.
+type LoginAttempts struct {
+	Key         string    `bson:"key"`
+	Failures    int       `bson:"failures"`
+	LastFailure time.Time `bson:"last_failure"`
+	ExpiresAt   time.Time `bson:"expires_at"`
+}
+
+// AttemptStore persists failed login counters. AddFailure increments the
+// counter for key, starting over if the previous one had expired, and keeps
+// it for ttl after now.
+type AttemptStore interface {
+	Get(key string, now time.Time) (LoginAttempts, error)
+	AddFailure(key string, now time.Time, ttl time.Duration) (LoginAttempts, error)
+	Reset(key string) error
+}
+
+// ThrottlePolicy decides how long a key has to wait after its failures. The
+// first FreeAttempts failures cost nothing, then the delay doubles from
+// BaseDelay up to MaxDelay, and from LockoutAfter failures on the key is
+// locked for Lockout. MaxInFlight bounds how many logins for one key may be
+// checking a password at the same time.
+type ThrottlePolicy struct {
+	MaxInFlight  int
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockoutAfter int
+	Lockout      time.Duration
+	ResetAfter   time.Duration
+}
+
+// Usernames are locked quickly; IPs get more room since many users can sit
+// behind one NAT.
+var (
+	userPolicy = ThrottlePolicy{
+		MaxInFlight:  1,
+		FreeAttempts: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockoutAfter: 10,
+		Lockout:      30 * time.Minute,
+		ResetAfter:   time.Hour,
+	}
+	ipPolicy = ThrottlePolicy{
+		MaxInFlight:  4,
+		FreeAttempts: 20,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockoutAfter: 100,
+		Lockout:      30 * time.Minute,
+		ResetAfter:   time.Hour,
+	}
+)
+
+// retryAt returns when the next attempt is allowed; the zero time means now.
+func (p ThrottlePolicy) retryAt(a LoginAttempts) time.Time {
+	switch {
+	case a.Failures < p.FreeAttempts:
+		return time.Time{}
+	case a.Failures >= p.LockoutAfter:
+		return a.LastFailure.Add(p.Lockout)
+	}
+	delay := p.MaxDelay
+	if shift := a.Failures - p.FreeAttempts; shift < 30 {
+		delay = min(p.BaseDelay<<shift, p.MaxDelay)
+	}
+	return a.LastFailure.Add(delay)
+}
+
+// TooManyAttemptsError is returned by LoginUser while a username or IP is
+// throttled. The password is not checked in that case.
+type TooManyAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyAttemptsError) Error() string {
+	return fmt.Sprintf("too many login attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+type UnlockRequest struct {
+	Username string `json:"username,omitempty"`
+	IP       string `json:"ip,omitempty"`
+}
+
+var (
+	attemptStoreMu sync.RWMutex
+	attemptStore   AttemptStore = NewMemoryAttemptStore()
+)
+
+// NewAttemptStore picks MongoDB when infrastructure.InitDatabase has
+// connected and falls back to memory otherwise.
+func NewAttemptStore() AttemptStore {
+	if infrastructure.Database == nil {
+		return NewMemoryAttemptStore()
+	}
+	return NewMongoAttemptStore(infrastructure.Database)
+}
+
+// SetAttemptStore replaces the store used to throttle logins.
+func SetAttemptStore(s AttemptStore) {
+	attemptStoreMu.Lock()
+	attemptStore = s
+	attemptStoreMu.Unlock()
+}
+
+func attempts() AttemptStore {
+	attemptStoreMu.RLock()
+	defer attemptStoreMu.RUnlock()
+	return attemptStore
+}
+
+func userKey(username string) string { return "user:" + strings.ToLower(username) }
+func ipKey(ip string) string         { return "ip:" + ip }
+
+type throttleCheck struct {
+	key    string
+	policy ThrottlePolicy
+}
+
+func loginChecks(username, ip string) []throttleCheck {
+	checks := []throttleCheck{{userKey(username), userPolicy}}
+	if ip != "" {
+		checks = append(checks, throttleCheck{ipKey(ip), ipPolicy})
+	}
+	return checks
+}
+
+// inFlight counts the logins per key that passed beginLogin and have not
+// called release yet.
+var inFlight = struct {
+	sync.Mutex
+	n map[string]int
+}{n: make(map[string]int)}
+
+// beginLogin reserves a login slot for every key and then fails with
+// TooManyAttemptsError if any key must still wait. Without the reservation
+// a burst of concurrent logins would all read the counters before the first
+// failure was recorded and all pay for a password hash. release must be
+// called once the failure, if any, has been recorded.
+func beginLogin(checks []throttleCheck, now time.Time) (release func(), err error) {
+	inFlight.Lock()
+	for _, c := range checks {
+		if inFlight.n[c.key] >= c.policy.MaxInFlight {
+			inFlight.Unlock()
+			return nil, &TooManyAttemptsError{RetryAfter: time.Second}
+		}
+	}
+	for _, c := range checks {
+		inFlight.n[c.key]++
+	}
+	inFlight.Unlock()
+
+	release = func() {
+		inFlight.Lock()
+		for _, c := range checks {
+			if inFlight.n[c.key]--; inFlight.n[c.key] <= 0 {
+				delete(inFlight.n, c.key)
+			}
+		}
+		inFlight.Unlock()
+	}
+
+	var wait time.Duration
+	for _, c := range checks {
+		a, err := attempts().Get(c.key, now)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		if d := c.policy.retryAt(a).Sub(now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		release()
+		return nil, &TooManyAttemptsError{RetryAfter: wait}
+	}
+	return release, nil
+}
+
+func recordFailure(checks []throttleCheck, now time.Time) {
+	for _, c := range checks {
+		a, err := attempts().AddFailure(c.key, now, max(c.policy.ResetAfter, c.policy.Lockout))
+		if err != nil {
+			log.Printf("[AUTH] failed to record login failure for %s: %v", c.key, err)
+			continue
+		}
+		if a.Failures == c.policy.LockoutAfter {
+			log.Printf("[AUTH] %s locked for %s after %d failed logins", c.key, c.policy.Lockout, a.Failures)
+		}
+	}
+}
+
+// UnlockLogin clears the failure counters of a username and/or IP.
+func UnlockLogin(req UnlockRequest) error {
+	username := strings.TrimSpace(req.Username)
+	ip := strings.TrimSpace(req.IP)
+	if username == "" && ip == "" {
+		return fmt.Errorf("username or ip required")
+	}
+	if username != "" {
+		if err := attempts().Reset(userKey(username)); err != nil {
+			return err
+		}
+	}
+	if ip != "" {
+		if err := attempts().Reset(ipKey(ip)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClientIP is the address login attempts are throttled by. Forwarded
+// headers are ignored because any client could set them to dodge the
+// per-IP limit.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, r *http.Request, e *TooManyAttemptsError) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	httpx.Error(w, r, http.StatusTooManyRequests, "too_many_attempts", e.Error())
+}
+
+// Unlock is admin-only and clears lockouts for a username and/or IP.
+func Unlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	var req UnlockRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		httpx.Error(w, r, http.StatusBadRequest, "bad_json", "invalid input")
+		return
+	}
+
+	if strings.TrimSpace(req.Username) == "" && strings.TrimSpace(req.IP) == "" {
+		writeRequired(w, r, "username or ip required", "username", "ip")
+		return
+	}
+
+	if err := UnlockLogin(req); err != nil {
+		httpx.Error(w, r, http.StatusInternalServerError, "server_error", "failed to unlock")
+		return
+	}
+
+	admin, _ := UsernameFromContext(r.Context())
+	log.Printf("[AUTH] %s unlocked login for username=%q ip=%q", admin, req.Username, req.IP)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"message": "unlocked"})
+}
+
+type MemoryAttemptStore struct {
+	mu    sync.Mutex
+	items map[string]LoginAttempts
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{items: make(map[string]LoginAttempts)}
+}
+
+func (s *MemoryAttemptStore) Get(key string, now time.Time) (LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.items[key]
+	if !ok || !now.Before(a.ExpiresAt) {
+		return LoginAttempts{Key: key}, nil
+	}
+	return a, nil
+}
+
+func (s *MemoryAttemptStore) AddFailure(key string, now time.Time, ttl time.Duration) (LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, a := range s.items {
+		if !now.Before(a.ExpiresAt) {
+			delete(s.items, k)
+		}
+	}
+	a := s.items[key]
+	a.Key = key
+	a.Failures++
+	a.LastFailure = now
+	a.ExpiresAt = now.Add(ttl)
+	s.items[key] = a
+	return a, nil
+}
+
+func (s *MemoryAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, key)
+	return nil
+}
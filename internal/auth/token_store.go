@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"AdvancedProgramming/internal/infrastructure"
+)
+
+var (
+	ErrRefreshInvalid = errors.New("invalid refresh token")
+	ErrRefreshReused  = errors.New("refresh token reuse detected")
+)
+
+// RefreshToken is the stored form of a refresh token. Only the SHA-256 hash
+// of the token is kept. Tokens rotated from the same login share a Family,
+// which is revoked as a whole when a used token is presented again.
+type RefreshToken struct {
+	Hash         string     `bson:"hash"`
+	UserID       int        `bson:"user_id"`
+	Username     string     `bson:"username"`
+	Family       string     `bson:"family"`
+	TokenVersion int        `bson:"token_version"`
+	MFA          bool       `bson:"mfa"`
+	ExpiresAt    time.Time  `bson:"expires_at"`
+	UsedAt       *time.Time `bson:"used_at"`
+	Revoked      bool       `bson:"revoked"`
+	CreatedAt    time.Time  `bson:"created_at"`
+}
+
+// TokenStore keeps refresh tokens, revoked access token IDs and password
+// reset tokens.
+//
+// UseRefresh atomically marks a token as used and returns it. It fails with
+// ErrRefreshReused if the token was used before and with ErrRefreshInvalid
+// if it is unknown, expired or revoked. UseReset does the same for reset
+// tokens but fails with ErrResetInvalid in every case.
+type TokenStore interface {
+	SaveRefresh(rec RefreshToken) error
+	UseRefresh(hash string, now time.Time) (RefreshToken, error)
+	RevokeFamily(family string) error
+	RevokeAccess(jti string, expiresAt time.Time) error
+	IsAccessRevoked(jti string) (bool, error)
+	SaveReset(rec ResetToken) error
+	UseReset(hash string, now time.Time) (ResetToken, error)
+}
+
+var (
+	tokenStoreMu sync.RWMutex
+	tokenStore   TokenStore = NewMemoryTokenStore()
+)
+
+// NewTokenStore picks MongoDB when infrastructure.InitDatabase has connected
+// and falls back to memory otherwise.
+func NewTokenStore() TokenStore {
+	if infrastructure.Database == nil {
+		return NewMemoryTokenStore()
+	}
+	return NewMongoTokenStore(infrastructure.Database)
+}
+
+// SetTokenStore replaces the store used by the package-level auth functions.
+func SetTokenStore(s TokenStore) {
+	tokenStoreMu.Lock()
+	tokenStore = s
+	tokenStoreMu.Unlock()
+}
+
+func tokens() TokenStore {
+	tokenStoreMu.RLock()
+	defer tokenStoreMu.RUnlock()
+	return tokenStore
+}
+
+type MemoryTokenStore struct {
+	mu      sync.Mutex
+	refresh map[string]RefreshToken // hash -> token
+	revoked map[string]time.Time    // jti -> access token expiry
+	resets  map[string]ResetToken   // hash -> token
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		refresh: make(map[string]RefreshToken),
+		revoked: make(map[string]time.Time),
+		resets:  make(map[string]ResetToken),
+	}
+}
+
+func (s *MemoryTokenStore) SaveRefresh(rec RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(time.Now())
+	s.refresh[rec.Hash] = rec
+	return nil
+}
+
+func (s *MemoryTokenStore) UseRefresh(hash string, now time.Time) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.refresh[hash]
+	if !ok || rec.Revoked || !now.Before(rec.ExpiresAt) {
+		return RefreshToken{}, ErrRefreshInvalid
+	}
+	if rec.UsedAt != nil {
+		return rec, ErrRefreshReused
+	}
+	rec.UsedAt = &now
+	s.refresh[hash] = rec
+	return rec, nil
+}
+
+func (s *MemoryTokenStore) RevokeFamily(family string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, rec := range s.refresh {
+		if rec.Family == family {
+			rec.Revoked = true
+			s.refresh[hash] = rec
+		}
+	}
+	return nil
+}
+
+func (s *MemoryTokenStore) RevokeAccess(jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(time.Now())
+	s.revoked[jti] = expiresAt
+	return nil
+}
+
+func (s *MemoryTokenStore) IsAccessRevoked(jti string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.revoked[jti]
+	return ok, nil
+}
+
+func (s *MemoryTokenStore) SaveReset(rec ResetToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(time.Now())
+	s.resets[rec.Hash] = rec
+	return nil
+}
+
+func (s *MemoryTokenStore) UseReset(hash string, now time.Time) (ResetToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.resets[hash]
+	if !ok || rec.UsedAt != nil || !now.Before(rec.ExpiresAt) {
+		return ResetToken{}, ErrResetInvalid
+	}
+	rec.UsedAt = &now
+	s.resets[hash] = rec
+	return rec, nil
+}
+
+// pruneLocked drops entries that can no longer matter because the tokens
+// they refer to have expired anyway.
+func (s *MemoryTokenStore) pruneLocked(now time.Time) {
+	for hash, rec := range s.refresh {
+		if !now.Before(rec.ExpiresAt) {
+			delete(s.refresh, hash)
+		}
+	}
+	for jti, exp := range s.revoked {
+		if !now.Before(exp) {
+			delete(s.revoked, jti)
+		}
+	}
+	for hash, rec := range s.resets {
+		if !now.Before(rec.ExpiresAt) {
+			delete(s.resets, hash)
+		}
+	}
+}
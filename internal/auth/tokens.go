@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrTokenRevoked    = errors.New("token revoked")
+	ErrAccountDisabled = errors.New("account disabled")
+)
+
+// TokenPair is what a successful login or refresh returns. The access token
+// authorizes API calls; the refresh token can be exchanged once for a new
+// pair.
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// LogoutRequest optionally names the refresh token to revoke with the access
+// token. All ends every session of the user.
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token,omitempty"`
+	All          bool   `json:"all,omitempty"`
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens signs an access token for rec and stores a new refresh token in
+// family. An empty family starts a new one. mfa carries over to every token
+// refreshed from this pair.
+func issueTokens(rec UserRecord, family string, mfa bool) (TokenPair, error) {
+	access, err := GenerateJWT(rec.ID, rec.Username, rec.Role, rec.TokenVersion, mfa)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	if family == "" {
+		family = randomToken(16)
+	}
+	refresh := randomToken(32)
+	now := time.Now().UTC()
+	err = tokens().SaveRefresh(RefreshToken{
+		Hash:         hashToken(refresh),
+		UserID:       rec.ID,
+		Username:     rec.Username,
+		Family:       family,
+		TokenVersion: rec.TokenVersion,
+		MFA:          mfa,
+		ExpiresAt:    now.Add(refreshTokenTTL),
+		CreatedAt:    now,
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// RefreshTokens exchanges a refresh token for a new pair. Every refresh
+// token works once; presenting a used one again revokes its whole family,
+// since either the client or an attacker holds a stolen copy.
+func RefreshTokens(refreshToken string) (TokenPair, User, error) {
+	refreshToken = strings.TrimSpace(refreshToken)
+	if refreshToken == "" {
+		return TokenPair{}, User{}, ErrRefreshInvalid
+	}
+
+	old, err := tokens().UseRefresh(hashToken(refreshToken), time.Now().UTC())
+	if errors.Is(err, ErrRefreshReused) {
+		log.Printf("[AUTH] refresh token reuse for user %s, revoking session", old.Username)
+		if rerr := tokens().RevokeFamily(old.Family); rerr != nil {
+			log.Printf("[AUTH] failed to revoke token family: %v", rerr)
+		}
+		return TokenPair{}, User{}, err
+	}
+	if err != nil {
+		return TokenPair{}, User{}, err
+	}
+
+	rec, err := users().GetByUsername(old.Username)
+	if err != nil || rec.ID != old.UserID || rec.TokenVersion != old.TokenVersion {
+		return TokenPair{}, User{}, ErrRefreshInvalid
+	}
+	if rec.Disabled {
+		return TokenPair{}, User{}, ErrAccountDisabled
+	}
+
+	pair, err := issueTokens(rec, old.Family, old.MFA)
+	if err != nil {
+		return TokenPair{}, User{}, err
+	}
+	return pair, toUser(rec), nil
+}
+
+// LogoutSession revokes the access token described by claims and, if given, the
+// refresh token's family. With all set it bumps the user's token version,
+// which invalidates every token issued to them so far.
+func LogoutSession(claims Claims, req LogoutRequest) error {
+	if err := tokens().RevokeAccess(claims.ID, claims.ExpiresAt); err != nil {
+		return err
+	}
+
+	if req.RefreshToken != "" {
+		rt, err := tokens().UseRefresh(hashToken(req.RefreshToken), time.Now().UTC())
+		if err == nil || errors.Is(err, ErrRefreshReused) {
+			if rt.UserID == claims.UserID {
+				if err := tokens().RevokeFamily(rt.Family); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if req.All {
+		return RevokeAllSessions(claims.Username)
+	}
+	return nil
+}
+
+// RevokeAllSessions invalidates every access and refresh token issued to the
+// user so far.
+func RevokeAllSessions(username string) error {
+	_, err := users().Update(username, func(rec UserRecord) (UserRecord, error) {
+		rec.TokenVersion++
+		rec.UpdatedAt = time.Now().UTC()
+		return rec, nil
+	})
+	return err
+}
+
+// checkSession rejects tokens that were revoked by logout or whose user has
+// since bumped their token version or been removed, and fails with
+// ErrAccountDisabled for disabled users.
+func checkSession(claims Claims) error {
+	revoked, err := tokens().IsAccessRevoked(claims.ID)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrTokenRevoked
+	}
+
+	rec, err := users().GetByUsername(claims.Username)
+	if err == nil && rec.ID == claims.UserID && rec.Disabled {
+		return ErrAccountDisabled
+	}
+	if err != nil || rec.ID != claims.UserID || rec.TokenVersion != claims.TokenVersion {
+		return ErrTokenRevoked
+	}
+	return nil
+}
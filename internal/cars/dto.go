@@ -6,8 +6,11 @@ type CreateCarRequest struct {
 	Year    int    `json:"year"`
 	Price   int    `json:"price"`
 	Mileage int    `json:"mileage"`
+	Spec
 }
 
+// UpdateCarRequest changes only the fields that are present. An empty
+// string or zero clears an optional specification field.
 type UpdateCarRequest struct {
 	Brand   *string `json:"brand"`
 	Model   *string `json:"model"`
@@ -15,6 +18,18 @@ type UpdateCarRequest struct {
 	Price   *int    `json:"price"`
 	Mileage *int    `json:"mileage"`
 	Status  *Status `json:"status"`
+
+	VIN          *string       `json:"vin"`
+	BodyType     *BodyType     `json:"body_type"`
+	FuelType     *FuelType     `json:"fuel_type"`
+	Transmission *Transmission `json:"transmission"`
+	Drivetrain   *Drivetrain   `json:"drivetrain"`
+	EngineVolume *float64      `json:"engine_volume"`
+	EnginePower  *int          `json:"engine_power"`
+	Color        *string       `json:"color"`
+	Owners       *int          `json:"owners"`
+	Condition    *Condition    `json:"condition"`
+	Description  *string       `json:"description"`
 }
 
 type CarResponse struct {
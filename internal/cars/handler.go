@@ -2,7 +2,9 @@ package cars
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"reflect"
 	"strconv"
 	"strings"
 
@@ -21,9 +23,25 @@ func NewHandler(svc *Service) *Handler {
 func (h *Handler) Cars(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		list := h.svc.List()
-		filtered := filterCars(list, r)
-		httpx.WriteJSON(w, http.StatusOK, filtered)
+		q, err := parseListQuery(r)
+		if err != nil {
+			httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("bad_query", "Invalid query parameters").WithDetails(httpx.Details(err)...))
+			return
+		}
+		res, err := h.svc.List(q)
+		if err != nil {
+			if err == ErrInvalidQuery {
+				httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("bad_query", "Invalid query parameters"))
+				return
+			}
+			httpx.WriteError(w, r, http.StatusInternalServerError, httpx.Err("server_error", "Internal server error"))
+			return
+		}
+		meta := httpx.Meta{Total: res.Total, Limit: q.Limit, NextCursor: res.NextCursor}
+		if q.Cursor == "" {
+			meta.Page = q.Page
+		}
+		httpx.WriteList(w, http.StatusOK, res.Items, meta)
 		return
 
 	case http.MethodPost:
@@ -31,17 +49,22 @@ func (h *Handler) Cars(w http.ResponseWriter, r *http.Request) {
 		dec := json.NewDecoder(r.Body)
 		dec.DisallowUnknownFields()
 		if err := dec.Decode(&req); err != nil {
-			httpx.WriteError(w, http.StatusBadRequest, httpx.Err("bad_json", "Invalid JSON body"))
+			httpx.WriteError(w, r, http.StatusBadRequest, decodeError(err))
 			return
 		}
 
 		created, err := h.svc.Create(req)
 		if err != nil {
-			if err == ErrValidation {
-				httpx.WriteError(w, http.StatusBadRequest, httpx.Err("validation_error", "Invalid car fields"))
+			if details := httpx.Details(err); details != nil {
+				httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("validation_error", "Invalid car fields").WithDetails(details...))
+				return
+			}
+			if errors.Is(err, ErrDuplicateVIN) {
+				httpx.WriteError(w, r, http.StatusConflict, httpx.Err("duplicate_vin", err.Error()).WithDetails(
+					httpx.FieldError{Field: "vin", Code: "duplicate", Message: err.Error()}))
 				return
 			}
-			httpx.WriteError(w, http.StatusInternalServerError, httpx.Err("server_error", "Internal server error"))
+			httpx.WriteError(w, r, http.StatusInternalServerError, httpx.Err("server_error", "Internal server error"))
 			return
 		}
 
@@ -49,22 +72,26 @@ func (h *Handler) Cars(w http.ResponseWriter, r *http.Request) {
 		return
 
 	default:
-		httpx.WriteError(w, http.StatusMethodNotAllowed, httpx.Err("method_not_allowed", "Method not allowed"))
+		httpx.WriteError(w, r, http.StatusMethodNotAllowed, httpx.Err("method_not_allowed", "Method not allowed"))
 		return
 	}
 }
 
-// GET/PUT/DELETE /cars/{id}
+// GET/PUT/DELETE /cars/{id}, plus the image routes below it
 func (h *Handler) CarByID(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/cars/")
-	if path == "" || strings.Contains(path, "/") {
-		httpx.WriteError(w, http.StatusNotFound, httpx.Err("not_found", "Not found"))
+	if path == "" {
+		httpx.WriteError(w, r, http.StatusNotFound, httpx.Err("not_found", "Not found"))
+		return
+	}
+	if strings.Contains(path, "/") {
+		h.carImages(w, r, path)
 		return
 	}
 
 	id, err := strconv.Atoi(path)
 	if err != nil || id <= 0 {
-		httpx.WriteError(w, http.StatusBadRequest, httpx.Err("bad_id", "Invalid car id"))
+		httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("bad_id", "Invalid car id"))
 		return
 	}
 
@@ -73,10 +100,10 @@ func (h *Handler) CarByID(w http.ResponseWriter, r *http.Request) {
 		car, err := h.svc.GetByID(id)
 		if err != nil {
 			if err == ErrNotFound {
-				httpx.WriteError(w, http.StatusNotFound, httpx.Err("not_found", "Car not found"))
+				httpx.WriteError(w, r, http.StatusNotFound, httpx.Err("not_found", "Car not found"))
 				return
 			}
-			httpx.WriteError(w, http.StatusInternalServerError, httpx.Err("server_error", "Internal server error"))
+			httpx.WriteError(w, r, http.StatusInternalServerError, httpx.Err("server_error", "Internal server error"))
 			return
 		}
 		httpx.WriteJSON(w, http.StatusOK, car)
@@ -87,21 +114,26 @@ func (h *Handler) CarByID(w http.ResponseWriter, r *http.Request) {
 		dec := json.NewDecoder(r.Body)
 		dec.DisallowUnknownFields()
 		if err := dec.Decode(&req); err != nil {
-			httpx.WriteError(w, http.StatusBadRequest, httpx.Err("bad_json", "Invalid JSON body"))
+			httpx.WriteError(w, r, http.StatusBadRequest, decodeError(err))
 			return
 		}
 
 		updated, err := h.svc.Update(id, req)
 		if err != nil {
 			if err == ErrNotFound {
-				httpx.WriteError(w, http.StatusNotFound, httpx.Err("not_found", "Car not found"))
+				httpx.WriteError(w, r, http.StatusNotFound, httpx.Err("not_found", "Car not found"))
+				return
+			}
+			if details := httpx.Details(err); details != nil {
+				httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("validation_error", "Invalid car fields").WithDetails(details...))
 				return
 			}
-			if err == ErrValidation {
-				httpx.WriteError(w, http.StatusBadRequest, httpx.Err("validation_error", "Invalid car fields"))
+			if errors.Is(err, ErrDuplicateVIN) {
+				httpx.WriteError(w, r, http.StatusConflict, httpx.Err("duplicate_vin", err.Error()).WithDetails(
+					httpx.FieldError{Field: "vin", Code: "duplicate", Message: err.Error()}))
 				return
 			}
-			httpx.WriteError(w, http.StatusInternalServerError, httpx.Err("server_error", "Internal server error"))
+			httpx.WriteError(w, r, http.StatusInternalServerError, httpx.Err("server_error", "Internal server error"))
 			return
 		}
 
@@ -111,10 +143,10 @@ func (h *Handler) CarByID(w http.ResponseWriter, r *http.Request) {
 	case http.MethodDelete:
 		if err := h.svc.Delete(id); err != nil {
 			if err == ErrNotFound {
-				httpx.WriteError(w, http.StatusNotFound, httpx.Err("not_found", "Car not found"))
+				httpx.WriteError(w, r, http.StatusNotFound, httpx.Err("not_found", "Car not found"))
 				return
 			}
-			httpx.WriteError(w, http.StatusInternalServerError, httpx.Err("server_error", "Internal server error"))
+			httpx.WriteError(w, r, http.StatusInternalServerError, httpx.Err("server_error", "Internal server error"))
 			return
 		}
 
@@ -122,40 +154,114 @@ func (h *Handler) CarByID(w http.ResponseWriter, r *http.Request) {
 		return
 
 	default:
-		httpx.WriteError(w, http.StatusMethodNotAllowed, httpx.Err("method_not_allowed", "Method not allowed"))
+		httpx.WriteError(w, r, http.StatusMethodNotAllowed, httpx.Err("method_not_allowed", "Method not allowed"))
 		return
 	}
 }
 
-func filterCars(cars []Car, r *http.Request) []Car {
-	brand := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("brand")))
-	model := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("model")))
-	status := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("status")))
-	minPrice, _ := strconv.Atoi(r.URL.Query().Get("min_price"))
-	maxPrice, _ := strconv.Atoi(r.URL.Query().Get("max_price"))
-	year, _ := strconv.Atoi(r.URL.Query().Get("year"))
-
-	out := make([]Car, 0, len(cars))
-	for _, car := range cars {
-		if brand != "" && !strings.Contains(strings.ToLower(car.Brand), brand) {
-			continue
-		}
-		if model != "" && !strings.Contains(strings.ToLower(car.Model), model) {
-			continue
-		}
-		if status != "" && strings.ToLower(string(car.Status)) != status {
-			continue
+// GET /cars/decode-vin/{vin}
+func (h *Handler) DecodeVIN(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpx.WriteError(w, r, http.StatusMethodNotAllowed, httpx.Err("method_not_allowed", "Method not allowed"))
+		return
+	}
+
+	info, err := DecodeVIN(strings.TrimPrefix(r.URL.Path, "/cars/decode-vin/"))
+	if err != nil {
+		httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("invalid_vin", "Invalid VIN").WithDetails(httpx.Details(err)...))
+		return
+	}
+	httpx.WriteJSON(w, http.StatusOK, info)
+}
+
+// decodeError names the offending field when the body has a value of the
+// wrong type, e.g. "year": "2020".
+func decodeError(err error) httpx.APIError {
+	apiErr := httpx.Err("bad_json", "Invalid JSON body")
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		want := "a number"
+		if typeErr.Type.Kind() == reflect.String {
+			want = "a string"
 		}
-		if minPrice > 0 && car.Price < minPrice {
+		return apiErr.WithDetails(httpx.FieldError{
+			Field:   typeErr.Field,
+			Code:    "invalid_type",
+			Message: typeErr.Field + " must be " + want,
+		})
+	}
+	return apiErr
+}
+
+// parseListQuery reads filters and paging from the query string. Limit
+// defaults to DefaultPageLimit and page to 1; enum filters must name a known
+// value.
+func parseListQuery(r *http.Request) (ListQuery, error) {
+	v := r.URL.Query()
+	q := ListQuery{
+		Brand:  strings.TrimSpace(v.Get("brand")),
+		Model:  strings.TrimSpace(v.Get("model")),
+		Status: Status(strings.ToLower(strings.TrimSpace(v.Get("status")))),
+		Sort:   strings.TrimSpace(v.Get("sort")),
+		Cursor: strings.TrimSpace(v.Get("cursor")),
+		Page:   1,
+		Limit:  DefaultPageLimit,
+
+		BodyType:     BodyType(strings.ToLower(strings.TrimSpace(v.Get("body_type")))),
+		FuelType:     FuelType(strings.ToLower(strings.TrimSpace(v.Get("fuel_type")))),
+		Transmission: Transmission(strings.ToLower(strings.TrimSpace(v.Get("transmission")))),
+		Drivetrain:   Drivetrain(strings.ToLower(strings.TrimSpace(v.Get("drivetrain")))),
+		Condition:    Condition(strings.ToLower(strings.TrimSpace(v.Get("condition")))),
+		Color:        strings.TrimSpace(v.Get("color")),
+		VIN:          NormalizeVIN(v.Get("vin")),
+	}
+	var verr httpx.ValidationError
+
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"min_price", &q.MinPrice},
+		{"max_price", &q.MaxPrice},
+		{"year", &q.Year},
+		{"page", &q.Page},
+		{"limit", &q.Limit},
+		{"min_power", &q.MinPower},
+		{"max_owners", &q.MaxOwners},
+	}
+	for _, p := range ints {
+		raw := v.Get(p.name)
+		if raw == "" {
 			continue
 		}
-		if maxPrice > 0 && car.Price > maxPrice {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			verr.Add(p.name, "invalid", p.name+" must be a non-negative integer")
 			continue
 		}
-		if year > 0 && car.Year != year {
-			continue
+		*p.dst = n
+	}
+	if q.Page < 1 || q.Page > MaxPage {
+		verr.Add("page", "out_of_range", "page must be between 1 and "+strconv.Itoa(MaxPage))
+	}
+	if q.Limit < 1 || q.Limit > MaxPageLimit {
+		verr.Add("limit", "out_of_range", "limit must be between 1 and "+strconv.Itoa(MaxPageLimit))
+	}
+	if _, _, err := parseSort(q.Sort); err != nil {
+		verr.Add("sort", "invalid", "sort must be one of id, price, year, mileage, created_at, optionally prefixed with -")
+	}
+	if q.Cursor != "" {
+		if _, err := decodeCursor(q.Cursor, q.Sort); err != nil {
+			verr.Add("cursor", "invalid", "cursor is malformed or was issued for a different sort")
 		}
-		out = append(out, car)
 	}
-	return out
+	checkEnum(&verr, "body_type", q.BodyType, BodyTypes)
+	checkEnum(&verr, "fuel_type", q.FuelType, FuelTypes)
+	checkEnum(&verr, "transmission", q.Transmission, Transmissions)
+	checkEnum(&verr, "drivetrain", q.Drivetrain, Drivetrains)
+	checkEnum(&verr, "condition", q.Condition, Conditions)
+	if err := verr.Err(); err != nil {
+		return ListQuery{}, err
+	}
+	return q, nil
 }
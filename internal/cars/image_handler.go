@@ -0,0 +1,179 @@
+package cars
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"AdvancedProgramming/internal/httpx"
+	"AdvancedProgramming/internal/media"
+)
+
+const (
+	// maxImagesPerUpload bounds one multipart request; the request body is
+	// capped accordingly.
+	maxImagesPerUpload = 10
+	maxUploadBytes     = maxImagesPerUpload*media.MaxImageBytes + 1<<20
+	// uploadMemory is how much of a multipart body is held in memory; the
+	// rest spills to temporary files.
+	uploadMemory = 8 << 20
+)
+
+type reorderImagesRequest struct {
+	Order []string `json:"order"`
+}
+
+// carImages serves the routes below /cars/{id}/images:
+//
+//	GET    /cars/{id}/images
+//	POST   /cars/{id}/images                  multipart, files in "image" or "images"
+//	PUT    /cars/{id}/images/order            {"order": [imageID, ...]}
+//	PUT    /cars/{id}/images/{imageID}/cover
+//	DELETE /cars/{id}/images/{imageID}
+func (h *Handler) carImages(w http.ResponseWriter, r *http.Request, path string) {
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || len(parts) > 4 || parts[1] != "images" {
+		httpx.WriteError(w, r, http.StatusNotFound, httpx.Err("not_found", "Not found"))
+		return
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || id <= 0 {
+		httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("bad_id", "Invalid car id"))
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		images, err := h.svc.ListImages(id)
+		if err != nil {
+			writeImageError(w, r, err)
+			return
+		}
+		httpx.WriteJSON(w, http.StatusOK, images)
+
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		h.uploadImages(w, r, id)
+
+	case len(parts) == 3 && parts[2] == "order" && r.Method == http.MethodPut:
+		var req reorderImagesRequest
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			httpx.WriteError(w, r, http.StatusBadRequest, decodeError(err))
+			return
+		}
+		car, err := h.svc.ReorderImages(id, req.Order)
+		if err != nil {
+			writeImageError(w, r, err)
+			return
+		}
+		httpx.WriteJSON(w, http.StatusOK, car.Images)
+
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		if err := h.svc.DeleteImage(r.Context(), id, parts[2]); err != nil {
+			writeImageError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 4 && parts[3] == "cover" && r.Method == http.MethodPut:
+		car, err := h.svc.SetCover(id, parts[2])
+		if err != nil {
+			writeImageError(w, r, err)
+			return
+		}
+		httpx.WriteJSON(w, http.StatusOK, car.Images)
+
+	case len(parts) == 2 || len(parts) == 3 || (len(parts) == 4 && parts[3] == "cover"):
+		httpx.WriteError(w, r, http.StatusMethodNotAllowed, httpx.Err("method_not_allowed", "Method not allowed"))
+
+	default:
+		httpx.WriteError(w, r, http.StatusNotFound, httpx.Err("not_found", "Not found"))
+	}
+}
+
+func (h *Handler) uploadImages(w http.ResponseWriter, r *http.Request, id int) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	if err := r.ParseMultipartForm(uploadMemory); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			httpx.WriteError(w, r, http.StatusRequestEntityTooLarge, httpx.Err("too_large", "Upload is too large"))
+			return
+		}
+		httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("bad_request", "Expected a multipart/form-data body"))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := len(r.MultipartForm.File["image"]) + len(r.MultipartForm.File["images"])
+	if files == 0 {
+		httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("validation_error", "No image uploaded").WithDetails(
+			httpx.FieldError{Field: "image", Code: "required", Message: "image is required"}))
+		return
+	}
+	if files > maxImagesPerUpload {
+		httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("too_many_images",
+			"At most "+strconv.Itoa(maxImagesPerUpload)+" images can be uploaded at once"))
+		return
+	}
+
+	uploads := make([]ImageUpload, 0, files)
+	var verr httpx.ValidationError
+	for _, field := range []string{"image", "images"} {
+		for i, fh := range r.MultipartForm.File[field] {
+			name := field
+			if len(r.MultipartForm.File[field]) > 1 {
+				name += "[" + strconv.Itoa(i) + "]"
+			}
+			if fh.Size > media.MaxImageBytes {
+				verr.Add(name, "too_large", "image must be at most "+strconv.Itoa(media.MaxImageBytes>>20)+" MB")
+				continue
+			}
+			uploads = append(uploads, ImageUpload{Field: name, Read: func() ([]byte, error) { return readPart(fh) }})
+		}
+	}
+	if err := verr.Err(); err != nil {
+		httpx.WriteError(w, r, http.StatusRequestEntityTooLarge, httpx.Err("too_large", "Image is too large").WithDetails(httpx.Details(err)...))
+		return
+	}
+
+	images, err := h.svc.AddImages(r.Context(), id, uploads)
+	if err != nil {
+		writeImageError(w, r, err)
+		return
+	}
+	httpx.WriteJSON(w, http.StatusCreated, images)
+}
+
+func readPart(fh *multipart.FileHeader) ([]byte, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, media.MaxImageBytes+1))
+}
+
+func writeImageError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		httpx.WriteError(w, r, http.StatusNotFound, httpx.Err("not_found", "Car not found"))
+	case errors.Is(err, ErrImageNotFound):
+		httpx.WriteError(w, r, http.StatusNotFound, httpx.Err("image_not_found", "Image not found"))
+	case errors.Is(err, ErrTooManyImages):
+		httpx.WriteError(w, r, http.StatusConflict, httpx.Err("too_many_images", err.Error()))
+	case errors.Is(err, ErrInvalidImageOrder):
+		httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("validation_error", "Invalid image order").WithDetails(
+			httpx.FieldError{Field: "order", Code: "invalid", Message: err.Error()}))
+	case httpx.Details(err) != nil:
+		httpx.WriteError(w, r, http.StatusUnsupportedMediaType, httpx.Err("invalid_image", "Invalid image").WithDetails(httpx.Details(err)...))
+	default:
+		log.Printf("Car image request failed: %v", err)
+		httpx.WriteError(w, r, http.StatusInternalServerError, httpx.Err("server_error", "Internal server error"))
+	}
+}
@@ -0,0 +1,261 @@
+package cars
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+
+	"AdvancedProgramming/internal/httpx"
+	"AdvancedProgramming/internal/media"
+)
+
+// MaxImagesPerCar caps how many photos one listing can hold.
+const MaxImagesPerCar = 20
+
+// MediaPrefix is the URL path stored images are served under.
+const MediaPrefix = "/media/"
+
+var (
+	ErrImageNotFound     = errors.New("image not found")
+	ErrTooManyImages     = fmt.Errorf("a car can have at most %d images", MaxImagesPerCar)
+	ErrNoImageStorage    = errors.New("image storage is not configured")
+	ErrInvalidImageOrder = errors.New("order must list every image of the car exactly once")
+)
+
+// SetImageStorage sets where uploaded images and their thumbnails are kept.
+func (s *Service) SetImageStorage(st media.Storage) {
+	s.mu.Lock()
+	s.media = st
+	s.mu.Unlock()
+}
+
+func (s *Service) imageStorage() media.Storage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.media
+}
+
+// ImageUpload is one file of a multipart upload. Field names the form field
+// it came from and is used in validation details. Read returns the file's
+// bytes and may be called more than once, so only one upload needs to be in
+// memory at a time.
+type ImageUpload struct {
+	Field string
+	Read  func() ([]byte, error)
+}
+
+// AddImages checks every upload, stores the originals and their thumbnails
+// and appends them to the car in the given order. Nothing is added unless
+// all uploads are valid; the first image of a car becomes its cover.
+func (s *Service) AddImages(ctx context.Context, carID int, uploads []ImageUpload) ([]Image, error) {
+	st := s.imageStorage()
+	if st == nil {
+		return nil, ErrNoImageStorage
+	}
+	car, err := s.repo.GetByID(carID)
+	if err != nil {
+		return nil, err
+	}
+	if len(car.Images)+len(uploads) > MaxImagesPerCar {
+		return nil, ErrTooManyImages
+	}
+
+	var verr httpx.ValidationError
+	infos := make([]media.ImageInfo, len(uploads))
+	for i, up := range uploads {
+		data, err := up.Read()
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", up.Field, err)
+		}
+		info, err := media.Inspect(data)
+		switch {
+		case errors.Is(err, media.ErrUnsupportedType):
+			verr.Add(up.Field, "unsupported_type", err.Error())
+		case errors.Is(err, media.ErrImageTooLarge):
+			verr.Add(up.Field, "too_large", err.Error())
+		case err != nil:
+			verr.Add(up.Field, "invalid_image", err.Error())
+		}
+		infos[i] = info
+	}
+	if err := verr.Err(); err != nil {
+		return nil, err
+	}
+
+	added := make([]Image, 0, len(uploads))
+	var keys []string
+	cleanup := func() {
+		for _, key := range keys {
+			if err := st.Delete(context.WithoutCancel(ctx), key); err != nil {
+				log.Printf("Failed to remove image %s: %v", key, err)
+			}
+		}
+	}
+	for i, up := range uploads {
+		data, err := up.Read()
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("read %s: %w", up.Field, err)
+		}
+		thumb, err := media.Thumbnail(data)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		id, err := newImageID()
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		prefix := "cars/" + strconv.Itoa(carID) + "/" + id
+		img := Image{
+			ID:          id,
+			Key:         prefix + infos[i].Ext,
+			ThumbKey:    prefix + "_thumb.jpg",
+			ContentType: infos[i].ContentType,
+			Size:        len(data),
+			Width:       infos[i].Width,
+			Height:      infos[i].Height,
+			CreatedAt:   time.Now().UTC(),
+		}
+		img.URL = MediaPrefix + img.Key
+		img.ThumbnailURL = MediaPrefix + img.ThumbKey
+
+		if err := st.Put(ctx, img.Key, data, img.ContentType); err != nil {
+			cleanup()
+			return nil, err
+		}
+		keys = append(keys, img.Key)
+		if err := st.Put(ctx, img.ThumbKey, thumb, "image/jpeg"); err != nil {
+			cleanup()
+			return nil, err
+		}
+		keys = append(keys, img.ThumbKey)
+		added = append(added, img)
+	}
+
+	var stored []Image
+	_, err = s.repo.Update(carID, func(current Car) (Car, error) {
+		if len(current.Images)+len(added) > MaxImagesPerCar {
+			return Car{}, ErrTooManyImages
+		}
+		images := append(slices.Clone(current.Images), added...)
+		if current.Cover() == nil {
+			images[0].Cover = true
+		}
+		current.Images = images
+		stored = images[len(images)-len(added):]
+		return current, nil
+	})
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	return stored, nil
+}
+
+// ListImages returns the images of a car in display order.
+func (s *Service) ListImages(carID int) ([]Image, error) {
+	car, err := s.repo.GetByID(carID)
+	if err != nil {
+		return nil, err
+	}
+	if car.Images == nil {
+		return []Image{}, nil
+	}
+	return car.Images, nil
+}
+
+// DeleteImage removes an image and its stored files. When the cover is
+// removed the next image in order takes its place.
+func (s *Service) DeleteImage(ctx context.Context, carID int, imageID string) error {
+	var removed Image
+	_, err := s.repo.Update(carID, func(current Car) (Car, error) {
+		i := slices.IndexFunc(current.Images, func(img Image) bool { return img.ID == imageID })
+		if i < 0 {
+			return Car{}, ErrImageNotFound
+		}
+		removed = current.Images[i]
+		images := slices.Delete(slices.Clone(current.Images), i, i+1)
+		if removed.Cover && len(images) > 0 {
+			images[0].Cover = true
+		}
+		current.Images = images
+		return current, nil
+	})
+	if err != nil {
+		return err
+	}
+	s.removeFiles(ctx, removed)
+	return nil
+}
+
+// SetCover makes imageID the cover of the car.
+func (s *Service) SetCover(carID int, imageID string) (Car, error) {
+	return s.repo.Update(carID, func(current Car) (Car, error) {
+		if !slices.ContainsFunc(current.Images, func(img Image) bool { return img.ID == imageID }) {
+			return Car{}, ErrImageNotFound
+		}
+		images := slices.Clone(current.Images)
+		for i := range images {
+			images[i].Cover = images[i].ID == imageID
+		}
+		current.Images = images
+		return current, nil
+	})
+}
+
+// ReorderImages puts the images of a car in the given order, which must
+// name each of them exactly once.
+func (s *Service) ReorderImages(carID int, order []string) (Car, error) {
+	return s.repo.Update(carID, func(current Car) (Car, error) {
+		if len(order) != len(current.Images) {
+			return Car{}, ErrInvalidImageOrder
+		}
+		byID := make(map[string]Image, len(current.Images))
+		for _, img := range current.Images {
+			byID[img.ID] = img
+		}
+		images := make([]Image, 0, len(order))
+		for _, id := range order {
+			img, ok := byID[id]
+			if !ok {
+				return Car{}, ErrInvalidImageOrder
+			}
+			delete(byID, id)
+			images = append(images, img)
+		}
+		current.Images = images
+		return current, nil
+	})
+}
+
+// removeFiles deletes the stored files of images that are no longer
+// referenced. Failures only leave orphaned files behind, so they are logged.
+func (s *Service) removeFiles(ctx context.Context, images ...Image) {
+	st := s.imageStorage()
+	if st == nil {
+		return
+	}
+	for _, img := range images {
+		for _, key := range []string{img.Key, img.ThumbKey} {
+			if err := st.Delete(context.WithoutCancel(ctx), key); err != nil {
+				log.Printf("Failed to remove image %s: %v", key, err)
+			}
+		}
+	}
+}
+
+func newImageID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
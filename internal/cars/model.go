@@ -10,13 +10,122 @@ const (
 	StatusSold      Status = "sold"
 )
 
+type BodyType string
+
+const (
+	BodySedan       BodyType = "sedan"
+	BodyHatchback   BodyType = "hatchback"
+	BodyWagon       BodyType = "wagon"
+	BodySUV         BodyType = "suv"
+	BodyCoupe       BodyType = "coupe"
+	BodyConvertible BodyType = "convertible"
+	BodyPickup      BodyType = "pickup"
+	BodyVan         BodyType = "van"
+	BodyMinivan     BodyType = "minivan"
+)
+
+type FuelType string
+
+const (
+	FuelPetrol       FuelType = "petrol"
+	FuelDiesel       FuelType = "diesel"
+	FuelHybrid       FuelType = "hybrid"
+	FuelPluginHybrid FuelType = "plugin_hybrid"
+	FuelElectric     FuelType = "electric"
+	FuelLPG          FuelType = "lpg"
+)
+
+type Transmission string
+
+const (
+	TransmissionManual    Transmission = "manual"
+	TransmissionAutomatic Transmission = "automatic"
+	TransmissionCVT       Transmission = "cvt"
+	TransmissionDCT       Transmission = "dct"
+)
+
+type Drivetrain string
+
+const (
+	DrivetrainFWD Drivetrain = "fwd"
+	DrivetrainRWD Drivetrain = "rwd"
+	DrivetrainAWD Drivetrain = "awd"
+	Drivetrain4WD Drivetrain = "4wd"
+)
+
+type Condition string
+
+const (
+	ConditionNew     Condition = "new"
+	ConditionUsed    Condition = "used"
+	ConditionDamaged Condition = "damaged"
+)
+
+// The allowed values of each enum, in the order forms list them.
+var (
+	BodyTypes     = []BodyType{BodySedan, BodyHatchback, BodyWagon, BodySUV, BodyCoupe, BodyConvertible, BodyPickup, BodyVan, BodyMinivan}
+	FuelTypes     = []FuelType{FuelPetrol, FuelDiesel, FuelHybrid, FuelPluginHybrid, FuelElectric, FuelLPG}
+	Transmissions = []Transmission{TransmissionManual, TransmissionAutomatic, TransmissionCVT, TransmissionDCT}
+	Drivetrains   = []Drivetrain{DrivetrainFWD, DrivetrainRWD, DrivetrainAWD, Drivetrain4WD}
+	Conditions    = []Condition{ConditionNew, ConditionUsed, ConditionDamaged}
+)
+
 type Car struct {
-	ID        int       `json:"id"`
-	Brand     string    `json:"brand"`
-	Model     string    `json:"model"`
-	Year      int       `json:"year"`
-	Price     int       `json:"price"`
-	Mileage   int       `json:"mileage"`
-	Status    Status    `json:"status"`
-	CreatedAt time.Time `json:"created_at"`
+	ID      int    `json:"id" bson:"id"`
+	Brand   string `json:"brand" bson:"brand"`
+	Model   string `json:"model" bson:"model"`
+	Year    int    `json:"year" bson:"year"`
+	Price   int    `json:"price" bson:"price"`
+	Mileage int    `json:"mileage" bson:"mileage"`
+	Status  Status `json:"status" bson:"status"`
+	Spec    `bson:",inline"`
+
+	// Images are kept in display order; exactly one of them is the cover
+	// whenever the slice is not empty.
+	Images []Image `json:"images,omitempty" bson:"images,omitempty"`
+
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// Cover returns the cover image, or nil if the car has no images.
+func (c Car) Cover() *Image {
+	for i := range c.Images {
+		if c.Images[i].Cover {
+			return &c.Images[i]
+		}
+	}
+	return nil
+}
+
+// Image is an uploaded photo of a car. The original and its thumbnail live
+// in media storage under Key and ThumbKey and are served below /media/.
+type Image struct {
+	ID           string    `json:"id" bson:"id"`
+	Key          string    `json:"-" bson:"key"`
+	ThumbKey     string    `json:"-" bson:"thumb_key"`
+	URL          string    `json:"url" bson:"url"`
+	ThumbnailURL string    `json:"thumbnail_url" bson:"thumbnail_url"`
+	ContentType  string    `json:"content_type" bson:"content_type"`
+	Size         int       `json:"size" bson:"size"`
+	Width        int       `json:"width" bson:"width"`
+	Height       int       `json:"height" bson:"height"`
+	Cover        bool      `json:"cover" bson:"cover"`
+	CreatedAt    time.Time `json:"created_at" bson:"created_at"`
+}
+
+// Spec holds the optional specification buyers compare cars by. Zero values
+// mean unknown and are left out of storage, so cars saved before these
+// fields existed still match on update.
+type Spec struct {
+	VIN          string       `json:"vin,omitempty" bson:"vin,omitempty"`
+	BodyType     BodyType     `json:"body_type,omitempty" bson:"body_type,omitempty"`
+	FuelType     FuelType     `json:"fuel_type,omitempty" bson:"fuel_type,omitempty"`
+	Transmission Transmission `json:"transmission,omitempty" bson:"transmission,omitempty"`
+	Drivetrain   Drivetrain   `json:"drivetrain,omitempty" bson:"drivetrain,omitempty"`
+	EngineVolume float64      `json:"engine_volume,omitempty" bson:"engine_volume,omitempty"` // litres
+	EnginePower  int          `json:"engine_power,omitempty" bson:"engine_power,omitempty"`   // hp
+	Color        string       `json:"color,omitempty" bson:"color,omitempty"`
+	Owners       int          `json:"owners,omitempty" bson:"owners,omitempty"`
+	Condition    Condition    `json:"condition,omitempty" bson:"condition,omitempty"`
+	Description  string       `json:"description,omitempty" bson:"description,omitempty"`
 }
@@ -0,0 +1,285 @@
+package cars
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"AdvancedProgramming/internal/infrastructure"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const carsCollection = "cars"
+
+// maxUpdateRetries bounds how often Update re-reads a car that was changed
+// by someone else between the read and the write.
+const maxUpdateRetries = 5
+
+var errConcurrentUpdate = errors.New("car was modified concurrently")
+
+type MongoRepository struct {
+	coll *mongo.Collection
+}
+
+// vinIndex is the name of the unique index on vin; duplicate key errors
+// naming it are reported as ErrDuplicateVIN.
+const vinIndex = "vin_1"
+
+// NewMongoRepository creates the collection indexes. It fails if the unique
+// VIN index cannot be built, e.g. because stored cars already share a VIN,
+// since uniqueness would silently not be enforced otherwise.
+func NewMongoRepository(db *mongo.Database) (*MongoRepository, error) {
+	r := &MongoRepository{coll: db.Collection(carsCollection)}
+	_, err := r.coll.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "price", Value: 1}, {Key: "id", Value: 1}}},
+		{Keys: bson.D{{Key: "year", Value: 1}, {Key: "id", Value: 1}}},
+		{Keys: bson.D{{Key: "mileage", Value: 1}, {Key: "id", Value: 1}}},
+		{Keys: bson.D{{Key: "created_at", Value: 1}, {Key: "id", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}}},
+		{Keys: bson.D{{Key: "body_type", Value: 1}}},
+		{Keys: bson.D{{Key: "fuel_type", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("cars: failed to create indexes: %v", err)
+	}
+
+	// only cars with a VIN take part in the uniqueness check
+	_, err = r.coll.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "vin", Value: 1}},
+		Options: options.Index().SetName(vinIndex).SetUnique(true).
+			SetPartialFilterExpression(bson.M{"vin": bson.M{"$type": "string"}}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cars: unique VIN index %s: %w (remove duplicate VINs and restart)", vinIndex, err)
+	}
+	return r, nil
+}
+
+// isDuplicateVIN reports whether err is a duplicate key error on the VIN
+// index rather than on another unique index such as id.
+func isDuplicateVIN(err error) bool {
+	var we mongo.WriteException
+	if errors.As(err, &we) {
+		for _, e := range we.WriteErrors {
+			if e.Code == 11000 && strings.Contains(e.Message, "index: "+vinIndex+" ") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *MongoRepository) Create(c Car) (Car, error) {
+	id, err := infrastructure.NextSequence(context.TODO(), carsCollection)
+	if err != nil {
+		return Car{}, err
+	}
+	c.ID = id
+
+	if _, err := r.coll.InsertOne(context.TODO(), c); err != nil {
+		if isDuplicateVIN(err) {
+			return Car{}, ErrDuplicateVIN
+		}
+		return Car{}, err
+	}
+	return c, nil
+}
+
+func (r *MongoRepository) GetByID(id int) (Car, error) {
+	var c Car
+	err := r.coll.FindOne(context.TODO(), bson.M{"id": id}).Decode(&c)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Car{}, ErrNotFound
+	}
+	if err != nil {
+		return Car{}, err
+	}
+	return c, nil
+}
+
+func (r *MongoRepository) List(q ListQuery) (ListResult, error) {
+	field, desc, err := parseSort(q.Sort)
+	if err != nil {
+		return ListResult{}, err
+	}
+	dir := 1
+	if desc {
+		dir = -1
+	}
+
+	filter := listFilter(q)
+	total, err := r.coll.CountDocuments(context.TODO(), filter)
+	if err != nil {
+		return ListResult{}, err
+	}
+
+	opts := options.Find()
+	if field == "id" {
+		opts.SetSort(bson.D{{Key: "id", Value: dir}})
+	} else {
+		opts.SetSort(bson.D{{Key: field, Value: dir}, {Key: "id", Value: 1}})
+	}
+
+	if q.Cursor != "" {
+		after, err := decodeCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return ListResult{}, err
+		}
+		filter = bson.M{"$and": bson.A{filter, afterCursor(field, desc, after)}}
+	} else if skip := q.offset(); skip > 0 {
+		opts.SetSkip(int64(skip))
+	}
+	if q.Limit > 0 {
+		// fetch one extra car to know whether another page exists
+		opts.SetLimit(int64(q.Limit + 1))
+	}
+
+	cursor, err := r.coll.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return ListResult{}, err
+	}
+	items := make([]Car, 0)
+	if err := cursor.All(context.TODO(), &items); err != nil {
+		return ListResult{}, err
+	}
+
+	res := ListResult{Total: int(total)}
+	if q.Limit > 0 && len(items) > q.Limit {
+		items = items[:q.Limit]
+		res.NextCursor = encodeCursor(q.Sort, items[len(items)-1])
+	}
+	res.Items = items
+	return res, nil
+}
+
+func listFilter(q ListQuery) bson.M {
+	filter := bson.M{}
+	if q.Brand != "" {
+		filter["brand"] = bson.M{"$regex": regexp.QuoteMeta(q.Brand), "$options": "i"}
+	}
+	if q.Model != "" {
+		filter["model"] = bson.M{"$regex": regexp.QuoteMeta(q.Model), "$options": "i"}
+	}
+	if q.Status != "" {
+		filter["status"] = q.Status
+	}
+	price := bson.M{}
+	if q.MinPrice > 0 {
+		price["$gte"] = q.MinPrice
+	}
+	if q.MaxPrice > 0 {
+		price["$lte"] = q.MaxPrice
+	}
+	if len(price) > 0 {
+		filter["price"] = price
+	}
+	if q.Year > 0 {
+		filter["year"] = q.Year
+	}
+	exact := []struct {
+		field string
+		value string
+	}{
+		{"body_type", string(q.BodyType)},
+		{"fuel_type", string(q.FuelType)},
+		{"transmission", string(q.Transmission)},
+		{"drivetrain", string(q.Drivetrain)},
+		{"condition", string(q.Condition)},
+		{"vin", q.VIN},
+	}
+	for _, f := range exact {
+		if f.value != "" {
+			filter[f.field] = f.value
+		}
+	}
+	if q.Color != "" {
+		filter["color"] = bson.M{"$regex": regexp.QuoteMeta(q.Color), "$options": "i"}
+	}
+	if q.MinPower > 0 {
+		filter["engine_power"] = bson.M{"$gte": q.MinPower}
+	}
+	if q.MaxOwners > 0 {
+		// cars without a recorded owner count are kept, like in memory
+		filter["$or"] = bson.A{
+			bson.M{"owners": bson.M{"$lte": q.MaxOwners}},
+			bson.M{"owners": bson.M{"$exists": false}},
+		}
+	}
+	return filter
+}
+
+// afterCursor matches the cars that sort strictly after the cursor position
+// under the same ordering List uses: the sort field first, then ascending id.
+func afterCursor(field string, desc bool, after listCursor) bson.M {
+	if field == "id" {
+		if desc {
+			return bson.M{"id": bson.M{"$lt": after.ID}}
+		}
+		return bson.M{"id": bson.M{"$gt": after.ID}}
+	}
+
+	var value any = after.Value
+	if field == "created_at" {
+		value = time.UnixMilli(after.Value).UTC()
+	}
+	op := "$gt"
+	if desc {
+		op = "$lt"
+	}
+	return bson.M{"$or": bson.A{
+		bson.M{field: bson.M{op: value}},
+		bson.M{field: value, "id": bson.M{"$gt": after.ID}},
+	}}
+}
+
+// Update reads the car, applies updateFn and writes the result only if the
+// stored document still equals what was read. On a lost race it retries with
+// the fresh document, so updateFn always validates against current state.
+func (r *MongoRepository) Update(id int, updateFn func(Car) (Car, error)) (Car, error) {
+	for i := 0; i < maxUpdateRetries; i++ {
+		current, err := r.GetByID(id)
+		if err != nil {
+			return Car{}, err
+		}
+
+		updated, err := updateFn(current)
+		if err != nil {
+			return Car{}, err
+		}
+
+		// protect system fields
+		updated.ID = id
+		updated.CreatedAt = current.CreatedAt
+
+		res, err := r.coll.ReplaceOne(context.TODO(), current, updated)
+		if isDuplicateVIN(err) {
+			return Car{}, ErrDuplicateVIN
+		}
+		if err != nil {
+			return Car{}, err
+		}
+		if res.MatchedCount == 1 {
+			return updated, nil
+		}
+	}
+	return Car{}, errConcurrentUpdate
+}
+
+func (r *MongoRepository) Delete(id int) (Car, error) {
+	var c Car
+	err := r.coll.FindOneAndDelete(context.TODO(), bson.M{"id": id}).Decode(&c)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Car{}, ErrNotFound
+	}
+	if err != nil {
+		return Car{}, err
+	}
+	return c, nil
+}
@@ -0,0 +1,183 @@
+package cars
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+)
+
+var ErrInvalidQuery = errors.New("invalid list query")
+
+const (
+	DefaultPageLimit = 20
+	MaxPageLimit     = 100
+	// MaxPage bounds offset paging; deeper listings should use the cursor.
+	MaxPage = 10000
+)
+
+// ListQuery describes filtering, sorting and paging for Repository.List.
+// Brand, Model and Color match case-insensitive substrings, the enums and
+// VIN match exactly, and zero values are ignored.
+// A zero Limit returns every matching car. When Cursor is set Page is
+// ignored and the listing continues right after the car the cursor points at.
+type ListQuery struct {
+	Brand    string
+	Model    string
+	Status   Status
+	MinPrice int
+	MaxPrice int
+	Year     int
+
+	BodyType     BodyType
+	FuelType     FuelType
+	Transmission Transmission
+	Drivetrain   Drivetrain
+	Condition    Condition
+	Color        string
+	VIN          string
+	MinPower     int
+	MaxOwners    int
+
+	Sort   string
+	Page   int
+	Limit  int
+	Cursor string
+}
+
+// ListResult is one page of cars plus the total number of matches.
+// NextCursor is empty on the last page.
+type ListResult struct {
+	Items      []Car
+	Total      int
+	NextCursor string
+}
+
+// sortFields maps the public sort keys to the bson field they order by.
+var sortFields = map[string]string{
+	"id":         "id",
+	"price":      "price",
+	"year":       "year",
+	"mileage":    "mileage",
+	"created_at": "created_at",
+}
+
+// parseSort splits a sort key such as "-price" into its field and direction.
+// An empty key sorts by id ascending.
+func parseSort(sort string) (field string, desc bool, err error) {
+	if sort == "" {
+		return "id", false, nil
+	}
+	desc = strings.HasPrefix(sort, "-")
+	key := strings.TrimPrefix(sort, "-")
+	if _, ok := sortFields[key]; !ok {
+		return "", false, ErrInvalidQuery
+	}
+	return key, desc, nil
+}
+
+// sortValue returns the value of the sort field for c. Times are compared as
+// Unix milliseconds, the precision MongoDB stores them with.
+func sortValue(c Car, field string) int64 {
+	switch field {
+	case "price":
+		return int64(c.Price)
+	case "year":
+		return int64(c.Year)
+	case "mileage":
+		return int64(c.Mileage)
+	case "created_at":
+		return c.CreatedAt.UnixMilli()
+	default:
+		return int64(c.ID)
+	}
+}
+
+// listCursor points at the last car of a page. Sort is kept so a cursor
+// cannot be replayed against a different ordering.
+type listCursor struct {
+	Sort  string `json:"s"`
+	Value int64  `json:"v"`
+	ID    int    `json:"id"`
+}
+
+func encodeCursor(sort string, c Car) string {
+	field, _, _ := parseSort(sort)
+	b, _ := json.Marshal(listCursor{Sort: sort, Value: sortValue(c, field), ID: c.ID})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s, sort string) (listCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return listCursor{}, ErrInvalidQuery
+	}
+	var c listCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Sort != sort {
+		return listCursor{}, ErrInvalidQuery
+	}
+	return c, nil
+}
+
+// matches reports whether c passes the filters of q.
+func (q ListQuery) matches(c Car) bool {
+	if q.Brand != "" && !strings.Contains(strings.ToLower(c.Brand), strings.ToLower(q.Brand)) {
+		return false
+	}
+	if q.Model != "" && !strings.Contains(strings.ToLower(c.Model), strings.ToLower(q.Model)) {
+		return false
+	}
+	if q.Status != "" && c.Status != q.Status {
+		return false
+	}
+	if q.MinPrice > 0 && c.Price < q.MinPrice {
+		return false
+	}
+	if q.MaxPrice > 0 && c.Price > q.MaxPrice {
+		return false
+	}
+	if q.Year > 0 && c.Year != q.Year {
+		return false
+	}
+	if q.BodyType != "" && c.BodyType != q.BodyType {
+		return false
+	}
+	if q.FuelType != "" && c.FuelType != q.FuelType {
+		return false
+	}
+	if q.Transmission != "" && c.Transmission != q.Transmission {
+		return false
+	}
+	if q.Drivetrain != "" && c.Drivetrain != q.Drivetrain {
+		return false
+	}
+	if q.Condition != "" && c.Condition != q.Condition {
+		return false
+	}
+	if q.Color != "" && !strings.Contains(strings.ToLower(c.Color), strings.ToLower(q.Color)) {
+		return false
+	}
+	if q.VIN != "" && c.VIN != q.VIN {
+		return false
+	}
+	if q.MinPower > 0 && c.EnginePower < q.MinPower {
+		return false
+	}
+	if q.MaxOwners > 0 && c.Owners > q.MaxOwners {
+		return false
+	}
+	return true
+}
+
+// offset is the number of cars page-based paging skips. It saturates
+// instead of overflowing, so repositories can clamp it to the result size.
+func (q ListQuery) offset() int {
+	if q.Limit <= 0 || q.Page <= 1 {
+		return 0
+	}
+	if q.Page-1 > math.MaxInt/q.Limit {
+		return math.MaxInt
+	}
+	return (q.Page - 1) * q.Limit
+}
@@ -5,35 +5,76 @@ import (
 	"sort"
 	"sync"
 	"sync/atomic"
+
+	"AdvancedProgramming/internal/infrastructure"
+)
+
+var (
+	ErrNotFound     = errors.New("car not found")
+	ErrDuplicateVIN = errors.New("another car already has this VIN")
 )
 
-var ErrNotFound = errors.New("car not found")
+// Repository is the storage contract used by Service. Update receives the
+// current car and stores whatever updateFn returns, so validation can run
+// against the latest state without a separate read.
+type Repository interface {
+	Create(c Car) (Car, error)
+	GetByID(id int) (Car, error)
+	List(q ListQuery) (ListResult, error)
+	Update(id int, updateFn func(Car) (Car, error)) (Car, error)
+	// Delete removes the car and returns it as it was stored at that moment.
+	Delete(id int) (Car, error)
+}
+
+// NewRepository picks MongoDB when infrastructure.InitDatabase has connected
+// and falls back to memory otherwise.
+func NewRepository() (Repository, error) {
+	if infrastructure.Database == nil {
+		return NewMemoryRepository(), nil
+	}
+	return NewMongoRepository(infrastructure.Database)
+}
 
-type Repository struct {
+type MemoryRepository struct {
 	mu     sync.RWMutex
 	nextID int64
 	items  map[int]Car
 }
 
-func NewRepository() *Repository {
-	return &Repository{
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
 		items:  make(map[int]Car),
 		nextID: 0,
 	}
 }
 
-func (r *Repository) Create(c Car) Car {
-	id := int(atomic.AddInt64(&r.nextID, 1))
-	c.ID = id
-
+func (r *MemoryRepository) Create(c Car) (Car, error) {
 	r.mu.Lock()
-	r.items[id] = c
-	r.mu.Unlock()
+	defer r.mu.Unlock()
 
-	return c
+	if r.vinTaken(c.VIN, 0) {
+		return Car{}, ErrDuplicateVIN
+	}
+	c.ID = int(atomic.AddInt64(&r.nextID, 1))
+	r.items[c.ID] = c
+	return c, nil
+}
+
+// vinTaken reports whether a car other than id has vin. The caller holds
+// r.mu.
+func (r *MemoryRepository) vinTaken(vin string, id int) bool {
+	if vin == "" {
+		return false
+	}
+	for _, c := range r.items {
+		if c.VIN == vin && c.ID != id {
+			return true
+		}
+	}
+	return false
 }
 
-func (r *Repository) GetByID(id int) (Car, error) {
+func (r *MemoryRepository) GetByID(id int) (Car, error) {
 	r.mu.RLock()
 	c, ok := r.items[id]
 	r.mu.RUnlock()
@@ -44,20 +85,63 @@ func (r *Repository) GetByID(id int) (Car, error) {
 	return c, nil
 }
 
-func (r *Repository) List() []Car {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+func (r *MemoryRepository) List(q ListQuery) (ListResult, error) {
+	field, desc, err := parseSort(q.Sort)
+	if err != nil {
+		return ListResult{}, err
+	}
+	var after *listCursor
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return ListResult{}, err
+		}
+		after = &c
+	}
 
-	out := make([]Car, 0, len(r.items))
+	r.mu.RLock()
+	matched := make([]Car, 0, len(r.items))
 	for _, c := range r.items {
-		out = append(out, c)
+		if q.matches(c) {
+			matched = append(matched, c)
+		}
 	}
+	r.mu.RUnlock()
 
-	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
-	return out
+	// order by the sort field, ties broken by ascending id
+	less := func(a, b Car) bool {
+		va, vb := sortValue(a, field), sortValue(b, field)
+		if va != vb {
+			return (va < vb) != desc
+		}
+		return a.ID < b.ID
+	}
+	sort.Slice(matched, func(i, j int) bool { return less(matched[i], matched[j]) })
+
+	res := ListResult{Total: len(matched)}
+	start := 0
+	if after != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			v := sortValue(matched[i], field)
+			if v != after.Value {
+				return (v > after.Value) != desc
+			}
+			return matched[i].ID > after.ID
+		})
+	} else {
+		start = q.offset()
+	}
+	start = min(max(start, 0), len(matched))
+	end := len(matched)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+		res.NextCursor = encodeCursor(q.Sort, matched[end-1])
+	}
+	res.Items = matched[start:end]
+	return res, nil
 }
 
-func (r *Repository) Update(id int, updateFn func(Car) (Car, error)) (Car, error) {
+func (r *MemoryRepository) Update(id int, updateFn func(Car) (Car, error)) (Car, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -75,17 +159,21 @@ func (r *Repository) Update(id int, updateFn func(Car) (Car, error)) (Car, error
 	updated.ID = id
 	updated.CreatedAt = current.CreatedAt
 
+	if r.vinTaken(updated.VIN, id) {
+		return Car{}, ErrDuplicateVIN
+	}
 	r.items[id] = updated
 	return updated, nil
 }
 
-func (r *Repository) Delete(id int) error {
+func (r *MemoryRepository) Delete(id int) (Car, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if _, ok := r.items[id]; !ok {
-		return ErrNotFound
+	c, ok := r.items[id]
+	if !ok {
+		return Car{}, ErrNotFound
 	}
 	delete(r.items, id)
-	return nil
+	return c, nil
 }
@@ -5,4 +5,5 @@ import "net/http"
 func RegisterRoutes(mux *http.ServeMux, h *Handler) {
 	mux.HandleFunc("/cars", h.Cars)
 	mux.HandleFunc("/cars/", h.CarByID)
+	mux.HandleFunc("/cars/decode-vin/", h.DecodeVIN)
 }
@@ -1,38 +1,55 @@
 package cars
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"strings"
+	"sync"
 	"time"
+
+	"AdvancedProgramming/internal/httpx"
+	"AdvancedProgramming/internal/media"
 )
 
-var ErrValidation = errors.New("validation error")
+var ErrNotAvailable = errors.New("car is not available")
+
+// MinYear is the oldest model year the catalog accepts; the newest is next
+// year, since dealers list upcoming models early.
+const MinYear = 1950
 
 type Service struct {
-	repo *Repository
+	repo Repository
+
+	mu       sync.RWMutex
+	onDelete []func(id int)
+	media    media.Storage
 }
 
-func NewService(repo *Repository) *Service {
+func NewService(repo Repository) *Service {
 	return &Service{repo: repo}
 }
 
+// ValidateCreate reports every invalid field of req as an
+// *httpx.ValidationError.
+func ValidateCreate(req CreateCarRequest) error {
+	var verr httpx.ValidationError
+	checkRequired(&verr, "brand", strings.TrimSpace(req.Brand))
+	checkRequired(&verr, "model", strings.TrimSpace(req.Model))
+	checkYear(&verr, req.Year)
+	checkPrice(&verr, req.Price)
+	checkMileage(&verr, req.Mileage)
+	req.Spec.normalize().check(&verr)
+	return verr.Err()
+}
+
 func (s *Service) Create(req CreateCarRequest) (Car, error) {
+	if err := ValidateCreate(req); err != nil {
+		return Car{}, err
+	}
 	brand := strings.TrimSpace(req.Brand)
 	model := strings.TrimSpace(req.Model)
 
-	if brand == "" || model == "" {
-		return Car{}, ErrValidation
-	}
-	if req.Year < 1950 || req.Year > time.Now().Year()+1 {
-		return Car{}, ErrValidation
-	}
-	if req.Price <= 0 {
-		return Car{}, ErrValidation
-	}
-	if req.Mileage < 0 {
-		return Car{}, ErrValidation
-	}
-
 	car := Car{
 		Brand:     brand,
 		Model:     model,
@@ -40,75 +57,187 @@ func (s *Service) Create(req CreateCarRequest) (Car, error) {
 		Price:     req.Price,
 		Mileage:   req.Mileage,
 		Status:    StatusAvailable,
+		Spec:      req.Spec.normalize(),
 		CreatedAt: time.Now().UTC(),
 	}
 
-	created := s.repo.Create(car)
-	return created, nil
+	return s.repo.Create(car)
 }
 
 func (s *Service) GetByID(id int) (Car, error) {
 	return s.repo.GetByID(id)
 }
 
-func (s *Service) List() []Car {
-	return s.repo.List()
+// GetMany returns the cars with the given IDs in the same order. IDs of cars
+// that no longer exist are returned separately.
+func (s *Service) GetMany(ids []int) ([]Car, []int, error) {
+	found := make([]Car, 0, len(ids))
+	var missing []int
+	for _, id := range ids {
+		car, err := s.repo.GetByID(id)
+		if errors.Is(err, ErrNotFound) {
+			missing = append(missing, id)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		found = append(found, car)
+	}
+	return found, missing, nil
+}
+
+func (s *Service) List(q ListQuery) (ListResult, error) {
+	if q.Limit < 0 || q.Page < 0 || q.Page > MaxPage || q.Limit > MaxPageLimit {
+		return ListResult{}, ErrInvalidQuery
+	}
+	return s.repo.List(q)
 }
 
+// Update validates every field present in req before touching the stored
+// car, so a request with several bad fields reports all of them.
 func (s *Service) Update(id int, req UpdateCarRequest) (Car, error) {
+	var brand, model string
+	var verr httpx.ValidationError
+	if req.Brand != nil {
+		brand = strings.TrimSpace(*req.Brand)
+		checkRequired(&verr, "brand", brand)
+	}
+	if req.Model != nil {
+		model = strings.TrimSpace(*req.Model)
+		checkRequired(&verr, "model", model)
+	}
+	if req.Year != nil {
+		checkYear(&verr, *req.Year)
+	}
+	if req.Price != nil {
+		checkPrice(&verr, *req.Price)
+	}
+	if req.Mileage != nil {
+		checkMileage(&verr, *req.Mileage)
+	}
+	if req.Status != nil {
+		switch *req.Status {
+		case StatusAvailable, StatusReserved, StatusSold:
+		default:
+			verr.Add("status", "invalid", "status must be available, reserved or sold")
+		}
+	}
+	spec, applySpec := specUpdate(req)
+	spec.check(&verr)
+	if err := verr.Err(); err != nil {
+		return Car{}, err
+	}
+
 	return s.repo.Update(id, func(current Car) (Car, error) {
 		updated := current
-
 		if req.Brand != nil {
-			v := strings.TrimSpace(*req.Brand)
-			if v == "" {
-				return Car{}, ErrValidation
-			}
-			updated.Brand = v
+			updated.Brand = brand
 		}
-
 		if req.Model != nil {
-			v := strings.TrimSpace(*req.Model)
-			if v == "" {
-				return Car{}, ErrValidation
-			}
-			updated.Model = v
+			updated.Model = model
 		}
-
 		if req.Year != nil {
-			if *req.Year < 1950 || *req.Year > time.Now().Year()+1 {
-				return Car{}, ErrValidation
-			}
 			updated.Year = *req.Year
 		}
-
 		if req.Price != nil {
-			if *req.Price <= 0 {
-				return Car{}, ErrValidation
-			}
 			updated.Price = *req.Price
 		}
-
 		if req.Mileage != nil {
-			if *req.Mileage < 0 {
-				return Car{}, ErrValidation
-			}
 			updated.Mileage = *req.Mileage
 		}
-
 		if req.Status != nil {
-			switch *req.Status {
-			case StatusAvailable, StatusReserved, StatusSold:
-				updated.Status = *req.Status
-			default:
-				return Car{}, ErrValidation
-			}
+			updated.Status = *req.Status
 		}
-
+		updated.Spec = applySpec(current.Spec)
 		return updated, nil
 	})
 }
 
+// Delete removes the car and the files of the images it had when it was
+// deleted.
 func (s *Service) Delete(id int) error {
-	return s.repo.Delete(id)
+	car, err := s.repo.Delete(id)
+	if err != nil {
+		return err
+	}
+	s.removeFiles(context.Background(), car.Images...)
+
+	s.mu.RLock()
+	hooks := append([]func(int){}, s.onDelete...)
+	s.mu.RUnlock()
+	for _, fn := range hooks {
+		fn(id)
+	}
+	return nil
+}
+
+// OnDelete registers fn to run after a car was deleted, so other modules can
+// drop their references to it.
+func (s *Service) OnDelete(fn func(id int)) {
+	s.mu.Lock()
+	s.onDelete = append(s.onDelete, fn)
+	s.mu.Unlock()
+}
+
+// Reserve moves an available car to reserved. It fails with ErrNotAvailable
+// if the car is already reserved or sold, so two orders can never hold the
+// same car.
+func (s *Service) Reserve(id int) error {
+	return s.setStatus(id, StatusReserved, StatusAvailable)
+}
+
+// Release puts a reserved car back on sale. Cars that are not reserved are
+// left untouched.
+func (s *Service) Release(id int) error {
+	err := s.setStatus(id, StatusAvailable, StatusReserved)
+	if errors.Is(err, ErrNotAvailable) {
+		return nil
+	}
+	return err
+}
+
+// MarkSold moves a reserved or available car to sold.
+func (s *Service) MarkSold(id int) error {
+	return s.setStatus(id, StatusSold, StatusReserved, StatusAvailable)
+}
+
+// setStatus changes the car status to next only if the current status is one
+// of from. The check and the write happen inside a single repository update.
+func (s *Service) setStatus(id int, next Status, from ...Status) error {
+	_, err := s.repo.Update(id, func(current Car) (Car, error) {
+		for _, st := range from {
+			if current.Status == st {
+				current.Status = next
+				return current, nil
+			}
+		}
+		return Car{}, ErrNotAvailable
+	})
+	return err
+}
+
+func checkRequired(v *httpx.ValidationError, field, value string) {
+	if value == "" {
+		v.Add(field, "required", field+" is required")
+	}
+}
+
+func checkYear(v *httpx.ValidationError, year int) {
+	maxYear := time.Now().Year() + 1
+	if year < MinYear || year > maxYear {
+		v.Add("year", "out_of_range", fmt.Sprintf("year must be between %d and %d", MinYear, maxYear))
+	}
+}
+
+func checkPrice(v *httpx.ValidationError, price int) {
+	if price <= 0 {
+		v.Add("price", "not_positive", "price must be positive")
+	}
+}
+
+func checkMileage(v *httpx.ValidationError, mileage int) {
+	if mileage < 0 {
+		v.Add("mileage", "negative", "mileage must not be negative")
+	}
 }
@@ -0,0 +1,136 @@
+package cars
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"AdvancedProgramming/internal/httpx"
+)
+
+const (
+	maxEngineVolume   = 10.0
+	maxEnginePower    = 2000
+	maxOwners         = 50
+	maxColorLen       = 30
+	maxDescriptionLen = 2000
+)
+
+// normalize trims the text fields and lower-cases the enums, so "SUV " and
+// "suv" are the same body type.
+func (sp Spec) normalize() Spec {
+	sp.VIN = NormalizeVIN(sp.VIN)
+	sp.BodyType = BodyType(strings.ToLower(strings.TrimSpace(string(sp.BodyType))))
+	sp.FuelType = FuelType(strings.ToLower(strings.TrimSpace(string(sp.FuelType))))
+	sp.Transmission = Transmission(strings.ToLower(strings.TrimSpace(string(sp.Transmission))))
+	sp.Drivetrain = Drivetrain(strings.ToLower(strings.TrimSpace(string(sp.Drivetrain))))
+	sp.Condition = Condition(strings.ToLower(strings.TrimSpace(string(sp.Condition))))
+	sp.Color = strings.TrimSpace(sp.Color)
+	sp.Description = strings.TrimSpace(sp.Description)
+	return sp
+}
+
+// check adds an error for every set field of a normalized spec that is out
+// of range or not one of its enum values. Unset fields are always valid.
+func (sp Spec) check(v *httpx.ValidationError) {
+	checkVIN(v, sp.VIN)
+	checkEnum(v, "body_type", sp.BodyType, BodyTypes)
+	checkEnum(v, "fuel_type", sp.FuelType, FuelTypes)
+	checkEnum(v, "transmission", sp.Transmission, Transmissions)
+	checkEnum(v, "drivetrain", sp.Drivetrain, Drivetrains)
+	checkEnum(v, "condition", sp.Condition, Conditions)
+
+	if sp.EngineVolume < 0 || sp.EngineVolume > maxEngineVolume {
+		v.Add("engine_volume", "out_of_range", fmt.Sprintf("engine_volume must be between 0 and %g litres", maxEngineVolume))
+	}
+	if sp.EnginePower < 0 || sp.EnginePower > maxEnginePower {
+		v.Add("engine_power", "out_of_range", fmt.Sprintf("engine_power must be between 0 and %d hp", maxEnginePower))
+	}
+	if sp.Owners < 0 || sp.Owners > maxOwners {
+		v.Add("owners", "out_of_range", fmt.Sprintf("owners must be between 0 and %d", maxOwners))
+	}
+	if len(sp.Color) > maxColorLen {
+		v.Add("color", "too_long", fmt.Sprintf("color must be at most %d characters", maxColorLen))
+	}
+	if len(sp.Description) > maxDescriptionLen {
+		v.Add("description", "too_long", fmt.Sprintf("description must be at most %d characters", maxDescriptionLen))
+	}
+}
+
+func checkEnum[T ~string](v *httpx.ValidationError, field string, value T, allowed []T) {
+	if value == "" || slices.Contains(allowed, value) {
+		return
+	}
+	names := make([]string, len(allowed))
+	for i, a := range allowed {
+		names[i] = string(a)
+	}
+	v.Add(field, "invalid", field+" must be one of "+strings.Join(names, ", "))
+}
+
+// specUpdate returns the spec fields present in req, normalized, and
+// applies them to a stored spec.
+func specUpdate(req UpdateCarRequest) (Spec, func(Spec) Spec) {
+	var sp Spec
+	set := func(dst *string, src *string) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	set(&sp.VIN, req.VIN)
+	set((*string)(&sp.BodyType), (*string)(req.BodyType))
+	set((*string)(&sp.FuelType), (*string)(req.FuelType))
+	set((*string)(&sp.Transmission), (*string)(req.Transmission))
+	set((*string)(&sp.Drivetrain), (*string)(req.Drivetrain))
+	set((*string)(&sp.Condition), (*string)(req.Condition))
+	set(&sp.Color, req.Color)
+	set(&sp.Description, req.Description)
+	if req.EngineVolume != nil {
+		sp.EngineVolume = *req.EngineVolume
+	}
+	if req.EnginePower != nil {
+		sp.EnginePower = *req.EnginePower
+	}
+	if req.Owners != nil {
+		sp.Owners = *req.Owners
+	}
+	sp = sp.normalize()
+
+	apply := func(cur Spec) Spec {
+		if req.VIN != nil {
+			cur.VIN = sp.VIN
+		}
+		if req.BodyType != nil {
+			cur.BodyType = sp.BodyType
+		}
+		if req.FuelType != nil {
+			cur.FuelType = sp.FuelType
+		}
+		if req.Transmission != nil {
+			cur.Transmission = sp.Transmission
+		}
+		if req.Drivetrain != nil {
+			cur.Drivetrain = sp.Drivetrain
+		}
+		if req.EngineVolume != nil {
+			cur.EngineVolume = sp.EngineVolume
+		}
+		if req.EnginePower != nil {
+			cur.EnginePower = sp.EnginePower
+		}
+		if req.Color != nil {
+			cur.Color = sp.Color
+		}
+		if req.Owners != nil {
+			cur.Owners = sp.Owners
+		}
+		if req.Condition != nil {
+			cur.Condition = sp.Condition
+		}
+		if req.Description != nil {
+			cur.Description = sp.Description
+		}
+		return cur
+	}
+	return sp, apply
+}
@@ -0,0 +1,172 @@
+package cars
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"AdvancedProgramming/internal/httpx"
+)
+
+const vinLength = 17
+
+// VINInfo is what can be read from a VIN without an online lookup.
+// Manufacturer is empty when the WMI is not in the built-in table.
+type VINInfo struct {
+	VIN          string `json:"vin"`
+	WMI          string `json:"wmi"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Region       string `json:"region"`
+	ModelYear    int    `json:"model_year,omitempty"`
+	CheckDigit   bool   `json:"check_digit_verified"`
+}
+
+// vinValues are the ISO 3779 transliteration values; I, O and Q are never
+// used so they cannot be mistaken for 1 and 0.
+var vinValues = map[byte]int{
+	'A': 1, 'B': 2, 'C': 3, 'D': 4, 'E': 5, 'F': 6, 'G': 7, 'H': 8,
+	'J': 1, 'K': 2, 'L': 3, 'M': 4, 'N': 5, 'P': 7, 'R': 9,
+	'S': 2, 'T': 3, 'U': 4, 'V': 5, 'W': 6, 'X': 7, 'Y': 8, 'Z': 9,
+	'0': 0, '1': 1, '2': 2, '3': 3, '4': 4, '5': 5, '6': 6, '7': 7, '8': 8, '9': 9,
+}
+
+var vinWeights = [vinLength]int{8, 7, 6, 5, 4, 3, 2, 10, 0, 9, 8, 7, 6, 5, 4, 3, 2}
+
+// vinYearCodes lists the model year codes of position 10 from 1980 on; the
+// cycle repeats every 30 years.
+const vinYearCodes = "ABCDEFGHJKLMNPRSTVWXY123456789"
+
+// wmiManufacturers maps common world manufacturer identifiers to the brand
+// names used in the catalog.
+var wmiManufacturers = map[string]string{
+	"1C4": "Chrysler", "1C6": "Ram", "1FA": "Ford", "1FM": "Ford", "1FT": "Ford",
+	"1G1": "Chevrolet", "1GC": "Chevrolet", "1GN": "Chevrolet", "1GT": "GMC",
+	"1HG": "Honda", "1J4": "Jeep", "1LN": "Lincoln", "1N4": "Nissan", "1N6": "Nissan",
+	"1VW": "Volkswagen", "2C3": "Chrysler", "2FA": "Ford", "2G1": "Chevrolet",
+	"2HG": "Honda", "2HK": "Honda", "2T1": "Toyota", "2T3": "Toyota", "3FA": "Ford",
+	"3GN": "Chevrolet", "3HG": "Honda", "3N1": "Nissan", "3VW": "Volkswagen",
+	"4S3": "Subaru", "4S4": "Subaru", "4T1": "Toyota", "4T3": "Toyota", "4US": "BMW",
+	"5FN": "Honda", "5N1": "Nissan", "5NP": "Hyundai", "5TD": "Toyota", "5UX": "BMW",
+	"5XY": "Kia", "5YJ": "Tesla", "7SA": "Tesla",
+	"JF1": "Subaru", "JF2": "Subaru", "JHM": "Honda", "JM1": "Mazda", "JMZ": "Mazda",
+	"JN1": "Nissan", "JN8": "Nissan", "JS1": "Suzuki", "JT2": "Toyota", "JTD": "Toyota",
+	"JTE": "Toyota", "JTH": "Lexus", "JTJ": "Lexus", "JTM": "Toyota", "JTN": "Toyota",
+	"KL1": "Chevrolet", "KMH": "Hyundai", "KNA": "Kia", "KND": "Kia", "KNM": "Renault",
+	"LRW": "Tesla", "LSV": "Volkswagen", "SAJ": "Jaguar", "SAL": "Land Rover",
+	"SCA": "Rolls-Royce", "SCB": "Bentley", "SCF": "Aston Martin", "SHH": "Honda",
+	"SJN": "Nissan", "TMB": "Skoda", "TRU": "Audi", "VF1": "Renault", "VF3": "Peugeot",
+	"VF7": "Citroen", "VSS": "SEAT", "W0L": "Opel", "WAU": "Audi", "WA1": "Audi",
+	"WBA": "BMW", "WBS": "BMW", "WBY": "BMW", "WDB": "Mercedes-Benz",
+	"WDC": "Mercedes-Benz", "WDD": "Mercedes-Benz", "W1K": "Mercedes-Benz",
+	"W1N": "Mercedes-Benz", "WF0": "Ford", "WMW": "MINI", "WP0": "Porsche",
+	"WP1": "Porsche", "WVW": "Volkswagen", "WVG": "Volkswagen", "WV1": "Volkswagen",
+	"WV2": "Volkswagen", "XTA": "Lada", "YS3": "Saab", "YV1": "Volvo", "YV4": "Volvo",
+	"ZAR": "Alfa Romeo", "ZFA": "Fiat", "ZFF": "Ferrari", "ZHW": "Lamborghini",
+}
+
+// NormalizeVIN upper-cases vin and drops the spaces and dashes people type
+// while copying it from a document.
+func NormalizeVIN(vin string) string {
+	vin = strings.ToUpper(strings.TrimSpace(vin))
+	return strings.NewReplacer(" ", "", "-", "").Replace(vin)
+}
+
+// checkVIN adds an error for a normalized VIN that has the wrong length,
+// contains characters VINs never use, or, for North American VINs, fails
+// the ISO 3779 check digit. An empty VIN is valid since it is optional.
+func checkVIN(v *httpx.ValidationError, vin string) {
+	if vin == "" {
+		return
+	}
+	if len(vin) != vinLength {
+		v.Add("vin", "length", fmt.Sprintf("vin must be %d characters", vinLength))
+		return
+	}
+	for i := 0; i < len(vin); i++ {
+		if _, ok := vinValues[vin[i]]; !ok {
+			v.Add("vin", "invalid_character", fmt.Sprintf("vin has invalid character %q at position %d; I, O and Q are never used", vin[i], i+1))
+			return
+		}
+	}
+	if northAmerican(vin) && vin[8] != vinCheckDigit(vin) {
+		v.Add("vin", "check_digit", "vin check digit does not match, check for typos")
+	}
+}
+
+// vinCheckDigit computes position 9 of a VIN made of valid characters.
+func vinCheckDigit(vin string) byte {
+	sum := 0
+	for i := 0; i < vinLength; i++ {
+		sum += vinValues[vin[i]] * vinWeights[i]
+	}
+	if r := sum % 11; r != 10 {
+		return byte('0' + r)
+	}
+	return 'X'
+}
+
+// northAmerican reports whether vin was assigned in the US, Canada or
+// Mexico, where the check digit is mandatory.
+func northAmerican(vin string) bool {
+	return vin[0] >= '1' && vin[0] <= '5'
+}
+
+func vinRegion(c byte) string {
+	switch {
+	case c >= 'A' && c <= 'H':
+		return "Africa"
+	case c >= 'J' && c <= 'R':
+		return "Asia"
+	case c >= 'S' && c <= 'Z':
+		return "Europe"
+	case c >= '1' && c <= '5':
+		return "North America"
+	case c == '6' || c == '7':
+		return "Oceania"
+	}
+	return "South America"
+}
+
+// vinModelYear decodes position 10. Codes repeat every 30 years; North
+// American VINs tell the cycles apart by position 7, a letter meaning 2010
+// or later. Elsewhere the latest year that is not in the future is taken.
+func vinModelYear(vin string, now time.Time) int {
+	i := strings.IndexByte(vinYearCodes, vin[9])
+	if i < 0 {
+		return 0
+	}
+	year := 1980 + i
+	if northAmerican(vin) {
+		if vin[6] < '0' || vin[6] > '9' {
+			year += 30
+		}
+		return year
+	}
+	for year+30 <= now.Year()+1 {
+		year += 30
+	}
+	return year
+}
+
+// DecodeVIN validates vin and reads its manufacturer, region and model
+// year. Invalid VINs fail with an *httpx.ValidationError.
+func DecodeVIN(vin string) (VINInfo, error) {
+	vin = NormalizeVIN(vin)
+	var verr httpx.ValidationError
+	if vin == "" {
+		verr.Add("vin", "required", "vin is required")
+	}
+	checkVIN(&verr, vin)
+	if err := verr.Err(); err != nil {
+		return VINInfo{}, err
+	}
+
+	return VINInfo{
+		VIN:          vin,
+		WMI:          vin[:3],
+		Manufacturer: wmiManufacturers[vin[:3]],
+		Region:       vinRegion(vin[0]),
+		ModelYear:    vinModelYear(vin, time.Now()),
+		CheckDigit:   vin[8] == vinCheckDigit(vin),
+	}, nil
+}
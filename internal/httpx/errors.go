@@ -1,6 +1,24 @@
 package httpx
 
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// APIError is the error body every JSON endpoint returns. Code is stable and
+// meant for programs; Message is for humans and may change. Details lists
+// per-field problems for validation errors.
 type APIError struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Details   []FieldError `json:"details,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+// FieldError describes one invalid field of a body or query string.
+type FieldError struct {
+	Field   string `json:"field"`
 	Code    string `json:"code"`
 	Message string `json:"message"`
 }
@@ -8,3 +26,73 @@ type APIError struct {
 func Err(code, message string) APIError {
 	return APIError{Code: code, Message: message}
 }
+
+// CodeForStatus is the generic code for status, used when an error has no
+// more specific one.
+func CodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusTooManyRequests:
+		return "too_many_requests"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	}
+	if status >= 500 {
+		return "server_error"
+	}
+	return "bad_request"
+}
+
+// WithDetails returns a copy of e carrying the given field errors.
+func (e APIError) WithDetails(details ...FieldError) APIError {
+	e.Details = append([]FieldError(nil), details...)
+	return e
+}
+
+// ValidationError collects field errors so services can report every invalid
+// field at once instead of stopping at the first.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		parts = append(parts, f.Field+": "+f.Message)
+	}
+	return "validation failed: " + strings.Join(parts, "; ")
+}
+
+// Add records a problem with field.
+func (e *ValidationError) Add(field, code, message string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Code: code, Message: message})
+}
+
+// Err returns e if any field was added and nil otherwise.
+func (e *ValidationError) Err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Details returns the field errors carried by err, if it is a
+// ValidationError.
+func Details(err error) []FieldError {
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		return verr.Fields
+	}
+	return nil
+}
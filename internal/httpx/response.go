@@ -3,14 +3,25 @@ package httpx
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 type Envelope struct {
 	Success bool      `json:"success"`
 	Data    any       `json:"data,omitempty"`
+	Meta    *Meta     `json:"meta,omitempty"`
 	Error   *APIError `json:"error,omitempty"`
 }
 
+// Meta carries paging information for list responses.
+type Meta struct {
+	Total      int    `json:"total"`
+	Page       int    `json:"page,omitempty"`
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
 func WriteJSON(w http.ResponseWriter, status int, data any) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(status)
@@ -21,7 +32,41 @@ func WriteJSON(w http.ResponseWriter, status int, data any) {
 	})
 }
 
-func WriteError(w http.ResponseWriter, status int, apiErr APIError) {
+func WriteList(w http.ResponseWriter, status int, data any, meta Meta) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(Envelope{
+		Success: true,
+		Data:    data,
+		Meta:    &meta,
+	})
+}
+
+// WriteError writes apiErr in the standard envelope, or as an RFC 7807
+// problem document when the client asks for application/problem+json. The
+// request ID is filled in from r.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, apiErr APIError) {
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = RequestIDFrom(r.Context())
+	}
+
+	if wantsProblem(r) {
+		w.Header().Set("Content-Type", "application/problem+json; charset=utf-8")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(Problem{
+			Type:      "urn:carstore:error:" + apiErr.Code,
+			Title:     http.StatusText(status),
+			Status:    status,
+			Detail:    apiErr.Message,
+			Instance:  r.URL.Path,
+			Code:      apiErr.Code,
+			Errors:    apiErr.Details,
+			RequestID: apiErr.RequestID,
+		})
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(status)
 
@@ -29,4 +74,48 @@ func WriteError(w http.ResponseWriter, status int, apiErr APIError) {
 		Success: false,
 		Error:   &apiErr,
 	})
-}
\ No newline at end of file
+}
+
+// Error is shorthand for WriteError with a plain code and message.
+func Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	WriteError(w, r, status, Err(code, message))
+}
+
+// Problem is an RFC 7807 problem document. Code, Errors and RequestID are
+// extension members carrying the same data as APIError.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+// wantsProblem reports whether the Accept header prefers problem+json over
+// plain JSON. Anything else, including no Accept header, gets the envelope.
+func wantsProblem(r *http.Request) bool {
+	problem, plain := -1.0, -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		fields := strings.Split(part, ";")
+		mt := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, p := range fields[1:] {
+			k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if ok && strings.TrimSpace(k) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		switch mt {
+		case "application/problem+json":
+			problem = max(problem, q)
+		case "application/json":
+			plain = max(plain, q)
+		}
+	}
+	return problem > 0 && problem >= plain
+}
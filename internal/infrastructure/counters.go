@@ -0,0 +1,48 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NextSequence atomically increments the named counter in the "counters"
+// collection and returns the new value. The counter lives in the database,
+// so IDs keep growing across restarts and between replicas.
+func NextSequence(ctx context.Context, name string) (int, error) {
+	if Database == nil {
+		return 0, errors.New("database is not connected")
+	}
+
+	var doc struct {
+		Seq int `bson:"seq"`
+	}
+	err := Database.Collection("counters").FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": name},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	if err != nil {
+		return 0, err
+	}
+	return doc.Seq, nil
+}
+
+// EnsureSequenceAtLeast raises the named counter to floor if it is lower, so
+// collections that already hold documents do not get their IDs reused.
+func EnsureSequenceAtLeast(ctx context.Context, name string, floor int) error {
+	if Database == nil {
+		return errors.New("database is not connected")
+	}
+
+	_, err := Database.Collection("counters").UpdateOne(
+		ctx,
+		bson.M{"_id": name},
+		bson.M{"$max": bson.M{"seq": floor}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
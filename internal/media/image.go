@@ -0,0 +1,138 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	_ "image/png" // registers the PNG decoder
+	"net/http"
+)
+
+const (
+	// MaxImageBytes caps a single upload.
+	MaxImageBytes = 10 << 20
+	// MaxImagePixels guards against decompression bombs: a small file that
+	// decodes to a huge bitmap. 16 MP still fits a full-resolution phone
+	// photo and decodes to at most 64 MB.
+	MaxImagePixels = 16_000_000
+	maxImageSide   = 8000
+
+	ThumbWidth   = 320
+	ThumbHeight  = 240
+	thumbQuality = 80
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported image type, use JPEG, PNG or GIF")
+	ErrImageTooLarge   = errors.New("image dimensions are too large")
+	ErrCorruptImage    = errors.New("image could not be decoded")
+)
+
+// ImageInfo is what Inspect learns about an upload.
+type ImageInfo struct {
+	ContentType string
+	Ext         string
+	Width       int
+	Height      int
+}
+
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// Inspect sniffs the real content type from the bytes (the client's
+// Content-Type header is ignored) and checks the dimensions without
+// decoding the whole image.
+func Inspect(data []byte) (ImageInfo, error) {
+	ct := http.DetectContentType(data)
+	ext, ok := imageTypes[ct]
+	if !ok {
+		return ImageInfo{}, ErrUnsupportedType
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ImageInfo{}, ErrCorruptImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return ImageInfo{}, ErrCorruptImage
+	}
+	if cfg.Width > maxImageSide || cfg.Height > maxImageSide || cfg.Width*cfg.Height > MaxImagePixels {
+		return ImageInfo{}, ErrImageTooLarge
+	}
+	return ImageInfo{ContentType: ct, Ext: ext, Width: cfg.Width, Height: cfg.Height}, nil
+}
+
+// Thumbnail decodes an image that passed Inspect and returns a JPEG that
+// fits into ThumbWidth x ThumbHeight, keeping the aspect ratio. Images that
+// are already small are not enlarged; transparency is flattened onto white.
+func Thumbnail(data []byte) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrCorruptImage
+	}
+	b := src.Bounds()
+	w, h := fitInside(b.Dx(), b.Dy(), ThumbWidth, ThumbHeight)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, downscale(src, w, h), &jpeg.Options{Quality: thumbQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func fitInside(w, h, maxW, maxH int) (int, int) {
+	if w <= maxW && h <= maxH {
+		return w, h
+	}
+	if w*maxH > h*maxW {
+		return maxW, max(1, h*maxW/w)
+	}
+	return max(1, w*maxH/h), maxH
+}
+
+// downscale averages every source pixel that falls into a destination pixel
+// (a box filter), which is good enough for thumbnails and needs nothing
+// outside the standard library. It reads the decoded image in place, so the
+// only extra memory is the thumbnail itself. Colours are premultiplied, so
+// adding the missing alpha as white composites onto a white background.
+func downscale(src image.Image, w, h int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	at := func(x, y int) (r, g, bl, a uint32) { return src.At(x, y).RGBA() }
+	if fast, ok := src.(image.RGBA64Image); ok {
+		at = func(x, y int) (r, g, bl, a uint32) {
+			c := fast.RGBA64At(x, y)
+			return uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A)
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := at(b.Min.X+sx, b.Min.Y+sy)
+					r += uint64(pr)
+					g += uint64(pg)
+					bl += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			white := 0xffff - a/n
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8((r/n + white) >> 8)
+			dst.Pix[j+1] = uint8((g/n + white) >> 8)
+			dst.Pix[j+2] = uint8((bl/n + white) >> 8)
+			dst.Pix[j+3] = 0xff
+		}
+	}
+	return dst
+}
@@ -0,0 +1,87 @@
+package media
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"AdvancedProgramming/internal/httpx"
+)
+
+// Handler serves stored objects below prefix, e.g. GET /media/cars/1/ab.jpg.
+// Every upload gets a fresh key, so an object never changes once written and
+// clients may cache it for good.
+func Handler(st Storage, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			httpx.WriteError(w, r, http.StatusMethodNotAllowed, httpx.Err("method_not_allowed", "Method not allowed"))
+			return
+		}
+
+		body, info, err := st.Get(r.Context(), strings.TrimPrefix(r.URL.Path, prefix))
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidKey) {
+			httpx.WriteError(w, r, http.StatusNotFound, httpx.Err("not_found", "Not found"))
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to read %s: %v", r.URL.Path, err)
+			httpx.WriteError(w, r, http.StatusInternalServerError, httpx.Err("server_error", "Internal server error"))
+			return
+		}
+		defer body.Close()
+
+		h := w.Header()
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+		h.Set("X-Content-Type-Options", "nosniff")
+		if info.ETag != "" {
+			h.Set("ETag", info.ETag)
+		}
+		if !info.ModTime.IsZero() {
+			h.Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+		}
+		if notModified(r, info) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		contentType := info.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		h.Set("Content-Type", contentType)
+		if info.Size > 0 {
+			h.Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		}
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = io.Copy(w, body)
+		}
+	})
+}
+
+// notModified implements If-None-Match and, when that header is absent,
+// If-Modified-Since.
+func notModified(r *http.Request, info ObjectInfo) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if info.ETag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == info.ETag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !info.ModTime.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !info.ModTime.Truncate(time.Second).After(t)
+	}
+	return false
+}
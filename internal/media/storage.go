@@ -0,0 +1,62 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("object not found")
+	ErrInvalidKey = errors.New("invalid object key")
+)
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Size        int64
+	ContentType string
+	ETag        string
+	ModTime     time.Time
+}
+
+// Storage keeps image files by key, e.g. "cars/12/3f9c.jpg". Keys use
+// forward slashes and never contain "..".
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// NewStorage picks the backend from MEDIA_STORAGE: "s3" uses the S3_*
+// variables (see NewS3StorageFromEnv), anything else stores files under
+// MEDIA_DIR, "data/media" by default.
+func NewStorage() (Storage, error) {
+	switch strings.ToLower(os.Getenv("MEDIA_STORAGE")) {
+	case "s3":
+		return NewS3StorageFromEnv()
+	case "", "local":
+		dir := os.Getenv("MEDIA_DIR")
+		if dir == "" {
+			dir = "data/media"
+		}
+		return NewLocalStorage(dir)
+	default:
+		return nil, fmt.Errorf("unknown MEDIA_STORAGE %q, want local or s3", os.Getenv("MEDIA_STORAGE"))
+	}
+}
+
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -1,17 +1,23 @@
 package handlers
 
+import "AdvancedProgramming/internal/httpx"
+
 type CreateOrderRequest struct {
-	UserID  int    `json:"user_id"`
+	// UserID is optional; it defaults to the caller and only admins may set
+	// it to someone else.
+	UserID  int    `json:"user_id,omitempty"`
 	CarID   int    `json:"car_id"`
 	Comment string `json:"comment"`
 }
 
 type UpdateOrderStatusRequest struct {
 	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
 }
 
 type APIResponse struct {
 	Success bool        `json:"success"`
 	Message string      `json:"message"`
 	Data    interface{} `json:"data,omitempty"`
+	Meta    *httpx.Meta `json:"meta,omitempty"`
 }
@@ -1,11 +1,17 @@
 package handlers
 
 import (
+	"AdvancedProgramming/internal/auth"
+	"AdvancedProgramming/internal/httpx"
+	"AdvancedProgramming/internal/orders/repositories"
 	"AdvancedProgramming/internal/orders/services"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type OrderHandler struct {
@@ -20,19 +26,37 @@ func NewOrderHandler(s *services.OrderService) *OrderHandler {
 func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	var req CreateOrderRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondJSON(w, http.StatusBadRequest, APIResponse{
-			Success: false,
-			Message: "invalid JSON body",
-		})
+		httpx.Error(w, r, http.StatusBadRequest, "bad_json", "invalid JSON body")
 		return
 	}
 
-	order, err := h.service.CreateOrder(req.UserID, req.CarID, req.Comment)
+	callerID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		httpx.Error(w, r, http.StatusUnauthorized, "unauthorized", "unauthorized")
+		return
+	}
+	userID := callerID
+	if req.UserID != 0 && req.UserID != callerID {
+		role, _ := auth.RoleFromContext(r.Context())
+		if role != auth.RoleAdmin {
+			httpx.Error(w, r, http.StatusForbidden, "forbidden", "only admins can create orders for other users")
+			return
+		}
+		if _, err := auth.GetUserByID(req.UserID); err != nil {
+			if !errors.Is(err, auth.ErrUserNotFound) {
+				respondError(w, r, err)
+				return
+			}
+			httpx.WriteError(w, r, http.StatusNotFound, httpx.Err("user_not_found", "user not found").WithDetails(
+				httpx.FieldError{Field: "user_id", Code: "not_found", Message: "no user with this id"}))
+			return
+		}
+		userID = req.UserID
+	}
+
+	order, err := h.service.CreateOrder(userID, req.CarID, req.Comment, actorFromRequest(r))
 	if err != nil {
-		respondJSON(w, http.StatusBadRequest, APIResponse{
-			Success: false,
-			Message: err.Error(),
-		})
+		respondError(w, r, err)
 		return
 	}
 
@@ -43,64 +67,60 @@ func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// GetAllOrders - GET /orders
+// GetAllOrders - GET /orders?status=&user_id=&car_id=&created_from=&created_to=&limit=&cursor=
 func (h *OrderHandler) GetAllOrders(w http.ResponseWriter, r *http.Request) {
-	orders, err := h.service.GetAllOrders()
+	q, err := parseOrderQuery(r)
 	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, APIResponse{
-			Success: false,
-			Message: err.Error(),
-		})
+		httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("bad_query", "Invalid query parameters").WithDetails(httpx.Details(err)...))
 		return
 	}
 
-	respondJSON(w, http.StatusOK, APIResponse{
-		Success: true,
-		Data:    orders,
-	})
+	page, err := h.service.ListOrders(q)
+	respondPage(w, r, q, page, err)
 }
 
-// HandleOrderByID - GET/PUT/DELETE /orders/{id}
+// HandleOrderByID - GET/PUT/DELETE /orders/{id} | GET /orders/{id}/history
 func (h *OrderHandler) HandleOrderByID(w http.ResponseWriter, r *http.Request) {
 	// Парсим ID из пути /orders/{id}
 	path := strings.TrimPrefix(r.URL.Path, "/orders/")
-	if path == "" || strings.Contains(path, "/") {
-		respondJSON(w, http.StatusNotFound, APIResponse{
-			Success: false,
-			Message: "not found",
-		})
+	parts := strings.Split(path, "/")
+	if path == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "history") {
+		httpx.Error(w, r, http.StatusNotFound, "not_found", "not found")
 		return
 	}
 
-	id, err := strconv.Atoi(path)
+	id, err := strconv.Atoi(parts[0])
 	if err != nil || id <= 0 {
-		respondJSON(w, http.StatusBadRequest, APIResponse{
-			Success: false,
-			Message: "invalid order id",
-		})
+		httpx.Error(w, r, http.StatusBadRequest, "bad_id", "invalid order id")
+		return
+	}
+
+	if len(parts) == 2 {
+		if r.Method != http.MethodGet {
+			httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+			return
+		}
+		h.getOrderHistory(w, r, id)
 		return
 	}
 
 	switch r.Method {
 	case http.MethodGet:
-		h.getOrderByID(w, id)
+		h.getOrderByID(w, r, id)
 	case http.MethodPut:
 		h.updateOrderStatus(w, r, id)
 	case http.MethodDelete:
-		h.deleteOrder(w, id)
+		h.deleteOrder(w, r, id)
 	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
 	}
 }
 
 // getOrderByID - GET /orders/{id}
-func (h *OrderHandler) getOrderByID(w http.ResponseWriter, id int) {
+func (h *OrderHandler) getOrderByID(w http.ResponseWriter, r *http.Request, id int) {
 	order, err := h.service.GetOrder(id)
 	if err != nil {
-		respondJSON(w, http.StatusNotFound, APIResponse{
-			Success: false,
-			Message: err.Error(),
-		})
+		respondError(w, r, err)
 		return
 	}
 
@@ -110,23 +130,31 @@ func (h *OrderHandler) getOrderByID(w http.ResponseWriter, id int) {
 	})
 }
 
+// getOrderHistory - GET /orders/{id}/history
+func (h *OrderHandler) getOrderHistory(w http.ResponseWriter, r *http.Request, id int) {
+	history, err := h.service.GetOrderHistory(id)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    history,
+	})
+}
+
 // updateOrderStatus - PUT /orders/{id}
 func (h *OrderHandler) updateOrderStatus(w http.ResponseWriter, r *http.Request, id int) {
 	var req UpdateOrderStatusRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondJSON(w, http.StatusBadRequest, APIResponse{
-			Success: false,
-			Message: "invalid JSON body",
-		})
+		httpx.Error(w, r, http.StatusBadRequest, "bad_json", "invalid JSON body")
 		return
 	}
 
-	order, err := h.service.UpdateStatus(id, req.Status)
+	order, err := h.service.UpdateStatus(id, req.Status, actorFromRequest(r), req.Reason)
 	if err != nil {
-		respondJSON(w, http.StatusBadRequest, APIResponse{
-			Success: false,
-			Message: err.Error(),
-		})
+		respondError(w, r, err)
 		return
 	}
 
@@ -138,13 +166,10 @@ func (h *OrderHandler) updateOrderStatus(w http.ResponseWriter, r *http.Request,
 }
 
 // deleteOrder - DELETE /orders/{id}
-func (h *OrderHandler) deleteOrder(w http.ResponseWriter, id int) {
+func (h *OrderHandler) deleteOrder(w http.ResponseWriter, r *http.Request, id int) {
 	err := h.service.DeleteOrder(id)
 	if err != nil {
-		respondJSON(w, http.StatusNotFound, APIResponse{
-			Success: false,
-			Message: err.Error(),
-		})
+		respondError(w, r, err)
 		return
 	}
 
@@ -161,34 +186,102 @@ func (h *OrderHandler) GetUserOrders(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(path, "/")
 
 	if len(parts) != 2 || parts[1] != "orders" {
-		respondJSON(w, http.StatusBadRequest, APIResponse{
-			Success: false,
-			Message: "invalid path, expected /users/{id}/orders",
-		})
+		httpx.Error(w, r, http.StatusNotFound, "not_found", "invalid path, expected /users/{id}/orders")
 		return
 	}
 
 	userID, err := strconv.Atoi(parts[0])
 	if err != nil || userID <= 0 {
-		respondJSON(w, http.StatusBadRequest, APIResponse{
-			Success: false,
-			Message: "invalid user id",
-		})
+		httpx.Error(w, r, http.StatusBadRequest, "bad_id", "invalid user id")
 		return
 	}
 
-	orders, err := h.service.GetUserOrders(userID)
+	q, err := parseOrderQuery(r)
 	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, APIResponse{
-			Success: false,
-			Message: err.Error(),
-		})
+		httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("bad_query", "Invalid query parameters").WithDetails(httpx.Details(err)...))
+		return
+	}
+
+	page, err := h.service.GetUserOrders(userID, q)
+	respondPage(w, r, q, page, err)
+}
+
+// MyOrders - GET /me/orders
+func (h *OrderHandler) MyOrders(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		httpx.Error(w, r, http.StatusUnauthorized, "unauthorized", "unauthorized")
+		return
+	}
+
+	q, err := parseOrderQuery(r)
+	if err != nil {
+		httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("bad_query", "Invalid query parameters").WithDetails(httpx.Details(err)...))
+		return
+	}
+
+	page, err := h.service.GetUserOrders(userID, q)
+	respondPage(w, r, q, page, err)
+}
+
+// HandleMyOrder - GET /me/orders/{id} | POST /me/orders/{id}/cancel
+func (h *OrderHandler) HandleMyOrder(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		httpx.Error(w, r, http.StatusUnauthorized, "unauthorized", "unauthorized")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/me/orders/")
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "cancel") {
+		httpx.Error(w, r, http.StatusNotFound, "not_found", "not found")
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || id <= 0 {
+		httpx.Error(w, r, http.StatusBadRequest, "bad_id", "invalid order id")
+		return
+	}
+
+	if len(parts) == 2 {
+		if r.Method != http.MethodPost {
+			httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+			return
+		}
+		h.cancelMyOrder(w, r, userID, id)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		httpx.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	order, err := h.service.GetUserOrder(userID, id)
+	if err != nil {
+		respondError(w, r, err)
 		return
 	}
 
 	respondJSON(w, http.StatusOK, APIResponse{
 		Success: true,
-		Data:    orders,
+		Data:    order,
+	})
+}
+
+// cancelMyOrder - POST /me/orders/{id}/cancel
+func (h *OrderHandler) cancelMyOrder(w http.ResponseWriter, r *http.Request, userID, id int) {
+	order, err := h.service.CancelUserOrder(userID, id, actorFromRequest(r))
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, APIResponse{
+		Success: true,
+		Message: "order cancelled successfully",
+		Data:    order,
 	})
 }
 
@@ -196,10 +289,7 @@ func (h *OrderHandler) GetUserOrders(w http.ResponseWriter, r *http.Request) {
 func (h *OrderHandler) GetOrderStats(w http.ResponseWriter, r *http.Request) {
 	stats, err := h.service.GetOrderStats()
 	if err != nil {
-		respondJSON(w, http.StatusInternalServerError, APIResponse{
-			Success: false,
-			Message: err.Error(),
-		})
+		respondError(w, r, err)
 		return
 	}
 
@@ -213,25 +303,110 @@ func (h *OrderHandler) GetOrderStats(w http.ResponseWriter, r *http.Request) {
 func (h *OrderHandler) SearchOrders(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query().Get("q")
 	if query == "" {
-		respondJSON(w, http.StatusBadRequest, APIResponse{
-			Success: false,
-			Message: "search query required (?q=...)",
-		})
+		httpx.Error(w, r, http.StatusBadRequest, "bad_query", "search query required (?q=...)")
 		return
 	}
 
-	orders, err := h.service.SearchOrders(query)
+	q, err := parseOrderQuery(r)
+	if err != nil {
+		httpx.WriteError(w, r, http.StatusBadRequest, httpx.Err("bad_query", "Invalid query parameters").WithDetails(httpx.Details(err)...))
+		return
+	}
+
+	page, err := h.service.SearchOrders(query, q)
+	respondPage(w, r, q, page, err)
+}
+
+// actorFromRequest names the authenticated caller for the order history,
+// e.g. "admin:alice".
+func actorFromRequest(r *http.Request) string {
+	username, _ := auth.UsernameFromContext(r.Context())
+	role, _ := auth.RoleFromContext(r.Context())
+	return string(role) + ":" + username
+}
+
+// parseOrderQuery reads listing filters and paging from the query string.
+// created_from/created_to accept RFC 3339 or YYYY-MM-DD; a bare date in
+// created_to includes the whole day.
+func parseOrderQuery(r *http.Request) (repositories.OrderQuery, error) {
+	v := r.URL.Query()
+	q := repositories.OrderQuery{
+		Status: strings.ToLower(strings.TrimSpace(v.Get("status"))),
+		Cursor: strings.TrimSpace(v.Get("cursor")),
+	}
+	var verr httpx.ValidationError
+
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"user_id", &q.UserID},
+		{"car_id", &q.CarID},
+		{"limit", &q.Limit},
+	}
+	for _, p := range ints {
+		raw := v.Get(p.name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			verr.Add(p.name, "invalid", p.name+" must be a positive integer")
+			continue
+		}
+		*p.dst = n
+	}
+	if q.Limit > services.MaxPageLimit {
+		verr.Add("limit", "out_of_range", "limit must be between 1 and "+strconv.Itoa(services.MaxPageLimit))
+	}
+
+	var err error
+	if q.CreatedFrom, err = parseQueryTime(v.Get("created_from"), false); err != nil {
+		verr.Add("created_from", "invalid", "created_from must be RFC 3339 or YYYY-MM-DD")
+	}
+	if q.CreatedTo, err = parseQueryTime(v.Get("created_to"), true); err != nil {
+		verr.Add("created_to", "invalid", "created_to must be RFC 3339 or YYYY-MM-DD")
+	}
+	if err := verr.Err(); err != nil {
+		return repositories.OrderQuery{}, err
+	}
+	return q, nil
+}
+
+func parseQueryTime(raw string, endOfDay bool) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", raw)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24 * time.Hour)
+	}
+	return t, nil
+}
+
+// respondPage writes a page of orders with paging metadata, or the error
+// that produced it.
+func respondPage(w http.ResponseWriter, r *http.Request, q repositories.OrderQuery, page repositories.OrderPage, err error) {
 	if err != nil {
-		respondJSON(w, http.StatusBadRequest, APIResponse{
-			Success: false,
-			Message: err.Error(),
-		})
+		respondError(w, r, err)
 		return
 	}
 
+	limit := q.Limit
+	if limit == 0 {
+		limit = services.DefaultPageLimit
+	}
 	respondJSON(w, http.StatusOK, APIResponse{
 		Success: true,
-		Data:    orders,
+		Data:    page.Items,
+		Meta:    &httpx.Meta{Total: page.Total, Limit: limit, NextCursor: page.NextCursor},
 	})
 }
 
@@ -240,3 +415,32 @@ func respondJSON(w http.ResponseWriter, status int, resp APIResponse) {
 	w.WriteHeader(status)
 	_ = json.NewEncoder(w).Encode(resp)
 }
+
+// respondError maps a service error to its status and code. Errors it does
+// not know are logged and reported as a 500 without their text.
+func respondError(w http.ResponseWriter, r *http.Request, err error) {
+	var verr *httpx.ValidationError
+	var terr *services.TransitionError
+	switch {
+	case errors.As(err, &verr):
+		httpx.WriteError(w, r, http.StatusBadRequest,
+			httpx.Err("validation_error", verr.Error()).WithDetails(verr.Fields...))
+	case errors.Is(err, repositories.ErrNotFound):
+		httpx.Error(w, r, http.StatusNotFound, "not_found", err.Error())
+	case errors.Is(err, services.ErrCarNotFound):
+		httpx.Error(w, r, http.StatusNotFound, "car_not_found", err.Error())
+	case errors.Is(err, services.ErrCarUnavailable):
+		httpx.Error(w, r, http.StatusConflict, "car_unavailable", err.Error())
+	case errors.As(err, &terr):
+		httpx.Error(w, r, http.StatusConflict, "invalid_transition", err.Error())
+	case errors.Is(err, services.ErrCancelNotAllowed):
+		httpx.Error(w, r, http.StatusConflict, "cancel_not_allowed", err.Error())
+	case errors.Is(err, repositories.ErrInvalidCursor), errors.Is(err, services.ErrInvalidQuery):
+		httpx.Error(w, r, http.StatusBadRequest, "bad_query", err.Error())
+	case errors.Is(err, services.ErrInvalidOrderID), errors.Is(err, services.ErrInvalidUserID):
+		httpx.Error(w, r, http.StatusBadRequest, "bad_id", err.Error())
+	default:
+		log.Printf("[ORDERS] %s %s: %v", r.Method, r.URL.Path, err)
+		httpx.Error(w, r, http.StatusInternalServerError, "server_error", "Internal server error")
+	}
+}
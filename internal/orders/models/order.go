@@ -10,6 +10,33 @@ type Order struct {
 	Comment   string    `json:"comment" bson:"comment"`
 	CreatedAt time.Time `json:"createdat" bson:"createdat"`
 	UpdatedAt time.Time `json:"updatedat" bson:"updatedat"`
+
+	// Processing is the outcome of the automatic checks, set once the
+	// background processor has looked at the order.
+	Processing *ProcessingResult `json:"processing,omitempty" bson:"processing,omitempty"`
+
+	// History lists every status change, oldest first, starting with the
+	// creation of the order.
+	History []StatusChange `json:"history,omitempty" bson:"history,omitempty"`
+}
+
+// StatusChange is one entry of an order's audit trail. From is empty for the
+// entry that records the creation of the order.
+type StatusChange struct {
+	From   string    `json:"from,omitempty" bson:"from,omitempty"`
+	To     string    `json:"to" bson:"to"`
+	Actor  string    `json:"actor" bson:"actor"`
+	Reason string    `json:"reason,omitempty" bson:"reason,omitempty"`
+	At     time.Time `json:"at" bson:"at"`
+}
+
+// ProcessingResult records which decision the processing pipeline made and,
+// for rejected or held orders, which step made it and why.
+type ProcessingResult struct {
+	Decision string    `json:"decision" bson:"decision"`
+	Step     string    `json:"step,omitempty" bson:"step,omitempty"`
+	Reason   string    `json:"reason,omitempty" bson:"reason,omitempty"`
+	At       time.Time `json:"at" bson:"at"`
 }
 
 type OrderWithDetails struct {
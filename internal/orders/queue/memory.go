@@ -0,0 +1,105 @@
+package queue
+
+import (
+	"sync"
+	"time"
+)
+
+type MemoryQueue struct {
+	mu   sync.Mutex
+	jobs map[int]Job // order id -> job
+}
+
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{jobs: make(map[int]Job)}
+}
+
+func (q *MemoryQueue) Enqueue(orderID int, runAt time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, exists := q.jobs[orderID]; exists {
+		return nil
+	}
+	now := time.Now().UTC()
+	q.jobs[orderID] = Job{
+		OrderID:   orderID,
+		State:     StateReady,
+		RunAt:     runAt.UTC(),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	return nil
+}
+
+func (q *MemoryQueue) Dequeue(visibility time.Duration) (Job, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now().UTC()
+	var next Job
+	found := false
+	for _, job := range q.jobs {
+		if job.State != StateReady || job.RunAt.After(now) || job.LockedUntil.After(now) {
+			continue
+		}
+		if !found || job.RunAt.Before(next.RunAt) {
+			next = job
+			found = true
+		}
+	}
+	if !found {
+		return Job{}, false, nil
+	}
+
+	next.Attempts++
+	next.LockedUntil = now.Add(visibility)
+	next.LockToken = newLockToken()
+	next.UpdatedAt = now
+	q.jobs[next.OrderID] = next
+	return next, true, nil
+}
+
+// Complete forgets the job, so memory and the Dequeue scan only grow with
+// open jobs. Only pending orders are ever enqueued again, and a processed
+// order is no longer pending, so dropping it keeps Enqueue idempotent.
+func (q *MemoryQueue) Complete(job Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	current, ok := q.jobs[job.OrderID]
+	if !ok || current.LockToken != job.LockToken {
+		return ErrLockLost
+	}
+	delete(q.jobs, job.OrderID)
+	return nil
+}
+
+func (q *MemoryQueue) Retry(job Job, runAt time.Time, reason string) error {
+	return q.finish(job, func(j *Job) {
+		j.RunAt = runAt.UTC()
+		j.LastError = reason
+	})
+}
+
+func (q *MemoryQueue) DeadLetter(job Job, reason string) error {
+	return q.finish(job, func(j *Job) {
+		j.State = StateDead
+		j.LastError = reason
+	})
+}
+
+// finish applies fn to the stored job if job still holds its lock, then
+// releases the lock.
+func (q *MemoryQueue) finish(job Job, fn func(*Job)) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	current, ok := q.jobs[job.OrderID]
+	if !ok || current.LockToken != job.LockToken {
+		return ErrLockLost
+	}
+	fn(&current)
+	current.LockToken = ""
+	current.LockedUntil = time.Time{}
+	current.UpdatedAt = time.Now().UTC()
+	q.jobs[job.OrderID] = current
+	return nil
+}
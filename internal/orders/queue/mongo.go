@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const jobsCollection = "order_jobs"
+
+type MongoQueue struct {
+	coll *mongo.Collection
+}
+
+func NewMongoQueue(db *mongo.Database) *MongoQueue {
+	q := &MongoQueue{coll: db.Collection(jobsCollection)}
+	_, err := q.coll.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "orderid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "state", Value: 1}, {Key: "run_at", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("queue: failed to create indexes: %v", err)
+	}
+	return q
+}
+
+func (q *MongoQueue) Enqueue(orderID int, runAt time.Time) error {
+	now := time.Now().UTC()
+	_, err := q.coll.UpdateOne(
+		context.TODO(),
+		bson.M{"orderid": orderID},
+		bson.M{"$setOnInsert": Job{
+			OrderID:   orderID,
+			State:     StateReady,
+			RunAt:     runAt.UTC(),
+			CreatedAt: now,
+			UpdatedAt: now,
+		}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		// a concurrent Enqueue for the same order won the upsert
+		return nil
+	}
+	return err
+}
+
+func (q *MongoQueue) Dequeue(visibility time.Duration) (Job, bool, error) {
+	now := time.Now().UTC()
+	var job Job
+	err := q.coll.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{
+			"state":        StateReady,
+			"run_at":       bson.M{"$lte": now},
+			"locked_until": bson.M{"$lte": now},
+		},
+		bson.M{
+			"$set": bson.M{
+				"locked_until": now.Add(visibility),
+				"lock_token":   newLockToken(),
+				"updated_at":   now,
+			},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().
+			SetSort(bson.M{"run_at": 1}).
+			SetReturnDocument(options.After),
+	).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Job{}, false, nil
+	}
+	if err != nil {
+		return Job{}, false, err
+	}
+	return job, true, nil
+}
+
+func (q *MongoQueue) Complete(job Job) error {
+	return q.finish(job, bson.M{"state": StateDone})
+}
+
+func (q *MongoQueue) Retry(job Job, runAt time.Time, reason string) error {
+	return q.finish(job, bson.M{"run_at": runAt.UTC(), "last_error": reason})
+}
+
+func (q *MongoQueue) DeadLetter(job Job, reason string) error {
+	return q.finish(job, bson.M{"state": StateDead, "last_error": reason})
+}
+
+// finish applies set to the job if it still holds its lock, then releases
+// the lock.
+func (q *MongoQueue) finish(job Job, set bson.M) error {
+	set["lock_token"] = ""
+	set["locked_until"] = time.Time{}
+	set["updated_at"] = time.Now().UTC()
+	res, err := q.coll.UpdateOne(
+		context.TODO(),
+		bson.M{"orderid": job.OrderID, "lock_token": job.LockToken},
+		bson.M{"$set": set},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrLockLost
+	}
+	return nil
+}
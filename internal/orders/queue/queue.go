@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"AdvancedProgramming/internal/infrastructure"
+)
+
+const (
+	StateReady = "ready"
+	StateDone  = "done"
+	StateDead  = "dead"
+)
+
+// ErrLockLost is returned when a worker tries to finish a job whose
+// visibility timeout expired and that another worker has claimed since.
+var ErrLockLost = errors.New("job lock lost")
+
+// Job is one unit of order processing. There is at most one job per order.
+// A claimed job stays invisible to other workers until LockedUntil; if the
+// worker dies it becomes claimable again after that.
+type Job struct {
+	OrderID     int       `json:"order_id" bson:"orderid"`
+	State       string    `json:"state" bson:"state"`
+	Attempts    int       `json:"attempts" bson:"attempts"`
+	RunAt       time.Time `json:"run_at" bson:"run_at"`
+	LockedUntil time.Time `json:"locked_until" bson:"locked_until"`
+	LockToken   string    `json:"-" bson:"lock_token"`
+	LastError   string    `json:"last_error,omitempty" bson:"last_error"`
+	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+// Queue stores order processing jobs.
+//
+// Enqueue is idempotent: an order that already has a job keeps it. Dequeue
+// claims the ready job with the earliest RunAt that is due and unlocked,
+// increments its Attempts and hides it for the visibility timeout. Complete,
+// Retry and DeadLetter must be called with the job returned by Dequeue and
+// fail with ErrLockLost if the claim has since passed to another worker.
+type Queue interface {
+	Enqueue(orderID int, runAt time.Time) error
+	Dequeue(visibility time.Duration) (Job, bool, error)
+	Complete(job Job) error
+	Retry(job Job, runAt time.Time, reason string) error
+	DeadLetter(job Job, reason string) error
+}
+
+// NewQueue picks MongoDB when infrastructure.InitDatabase has connected and
+// falls back to memory otherwise.
+func NewQueue() Queue {
+	if infrastructure.Database == nil {
+		return NewMemoryQueue()
+	}
+	return NewMongoQueue(infrastructure.Database)
+}
+
+func newLockToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
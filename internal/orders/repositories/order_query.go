@@ -0,0 +1,199 @@
+package repositories
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"AdvancedProgramming/internal/infrastructure"
+	"AdvancedProgramming/internal/orders/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// OrderQuery filters and pages order listings. Zero values are ignored.
+// CreatedTo is exclusive and Comment matches a case-insensitive substring.
+// Results are ordered newest first; a zero Limit returns every match.
+type OrderQuery struct {
+	Status      string
+	UserID      int
+	CarID       int
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	Comment     string
+
+	Limit  int
+	Cursor string
+}
+
+// OrderPage is one page of orders plus the total number of matches.
+// NextCursor is empty on the last page.
+type OrderPage struct {
+	Items      []models.Order
+	Total      int
+	NextCursor string
+}
+
+// orderCursor points at the last order of a page.
+type orderCursor struct {
+	CreatedAt int64 `json:"t"`
+	ID        int   `json:"id"`
+}
+
+func encodeOrderCursor(o models.Order) string {
+	b, _ := json.Marshal(orderCursor{CreatedAt: o.CreatedAt.UnixNano(), ID: o.ID})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeOrderCursor(s string) (orderCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return orderCursor{}, ErrInvalidCursor
+	}
+	var c orderCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return orderCursor{}, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// newerFirst is the listing order: created time descending, then id
+// descending for orders created in the same instant.
+func newerFirst(a, b models.Order) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.ID > b.ID
+}
+
+// Find returns the orders matching q, newest first.
+func (r *OrderRepository) Find(q OrderQuery) (OrderPage, error) {
+	var after *orderCursor
+	if q.Cursor != "" {
+		c, err := decodeOrderCursor(q.Cursor)
+		if err != nil {
+			return OrderPage{}, err
+		}
+		after = &c
+	}
+
+	if r.useMemory() {
+		return r.findMemory(q, after)
+	}
+	return r.findMongo(q, after)
+}
+
+func (r *OrderRepository) findMemory(q OrderQuery, after *orderCursor) (OrderPage, error) {
+	comment := strings.ToLower(q.Comment)
+
+	r.mu.RLock()
+	matched := make([]models.Order, 0)
+	for _, o := range r.items {
+		if q.Status != "" && o.Status != q.Status {
+			continue
+		}
+		if q.UserID > 0 && o.UserID != q.UserID {
+			continue
+		}
+		if q.CarID > 0 && o.CarID != q.CarID {
+			continue
+		}
+		if !q.CreatedFrom.IsZero() && o.CreatedAt.Before(q.CreatedFrom) {
+			continue
+		}
+		if !q.CreatedTo.IsZero() && !o.CreatedAt.Before(q.CreatedTo) {
+			continue
+		}
+		if comment != "" && !strings.Contains(strings.ToLower(o.Comment), comment) {
+			continue
+		}
+		matched = append(matched, o)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool { return newerFirst(matched[i], matched[j]) })
+
+	page := OrderPage{Total: len(matched)}
+	start := 0
+	if after != nil {
+		pivot := models.Order{ID: after.ID, CreatedAt: time.Unix(0, after.CreatedAt)}
+		start = sort.Search(len(matched), func(i int) bool { return newerFirst(pivot, matched[i]) })
+	}
+	end := len(matched)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+		page.NextCursor = encodeOrderCursor(matched[end-1])
+	}
+	page.Items = matched[start:end]
+	return page, nil
+}
+
+func (r *OrderRepository) findMongo(q OrderQuery, after *orderCursor) (OrderPage, error) {
+	coll := infrastructure.Database.Collection("orders")
+
+	filter := bson.M{}
+	if q.Status != "" {
+		filter["status"] = q.Status
+	}
+	if q.UserID > 0 {
+		filter["userid"] = q.UserID
+	}
+	if q.CarID > 0 {
+		filter["carid"] = q.CarID
+	}
+	created := bson.M{}
+	if !q.CreatedFrom.IsZero() {
+		created["$gte"] = q.CreatedFrom
+	}
+	if !q.CreatedTo.IsZero() {
+		created["$lt"] = q.CreatedTo
+	}
+	if len(created) > 0 {
+		filter["createdat"] = created
+	}
+	if q.Comment != "" {
+		filter["comment"] = bson.M{"$regex": regexp.QuoteMeta(q.Comment), "$options": "i"}
+	}
+
+	total, err := coll.CountDocuments(context.TODO(), filter)
+	if err != nil {
+		return OrderPage{}, err
+	}
+
+	if after != nil {
+		t := time.Unix(0, after.CreatedAt).UTC()
+		filter = bson.M{"$and": bson.A{filter, bson.M{"$or": bson.A{
+			bson.M{"createdat": bson.M{"$lt": t}},
+			bson.M{"createdat": t, "id": bson.M{"$lt": after.ID}},
+		}}}}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}, {Key: "id", Value: -1}})
+	if q.Limit > 0 {
+		// fetch one extra order to know whether another page exists
+		opts.SetLimit(int64(q.Limit + 1))
+	}
+	cursor, err := coll.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return OrderPage{}, err
+	}
+	orders := make([]models.Order, 0)
+	if err := cursor.All(context.TODO(), &orders); err != nil {
+		return OrderPage{}, err
+	}
+
+	page := OrderPage{Total: int(total)}
+	if q.Limit > 0 && len(orders) > q.Limit {
+		orders = orders[:q.Limit]
+		page.NextCursor = encodeOrderCursor(orders[len(orders)-1])
+	}
+	page.Items = orders
+	return page, nil
+}
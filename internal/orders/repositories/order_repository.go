@@ -3,7 +3,8 @@ package repositories
 import (
 	"context"
 	"errors"
-	"strings"
+	"fmt"
+	"log"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,9 +12,16 @@ import (
 	"AdvancedProgramming/internal/infrastructure"
 	"AdvancedProgramming/internal/orders/models"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var ErrNotFound = errors.New("order not found")
+
+// maxUpdateRetries bounds how often Update re-reads an order that another
+// writer changed between the read and the write.
+const maxUpdateRetries = 5
+
 type OrderRepository struct {
 	nextID int64
 	mu     sync.RWMutex
@@ -28,8 +36,98 @@ func (r *OrderRepository) useMemory() bool {
 	return infrastructure.Database == nil
 }
 
+// Init prepares the MongoDB collection: it moves the id counter past any
+// order stored by an earlier run, gives fresh IDs to orders that share one,
+// and creates the indexes, including a unique index on id. It is a no-op in
+// memory mode. The server must not start if Init fails, since without the
+// unique index reads and writes by id could hit the wrong order.
+func (r *OrderRepository) Init() error {
+	if r.useMemory() {
+		return nil
+	}
+	coll := infrastructure.Database.Collection("orders")
+
+	var last models.Order
+	err := coll.FindOne(
+		context.TODO(),
+		bson.M{},
+		options.FindOne().SetSort(bson.M{"id": -1}),
+	).Decode(&last)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("find last order: %w", err)
+	}
+	if err := infrastructure.EnsureSequenceAtLeast(context.TODO(), "orders", last.ID); err != nil {
+		return fmt.Errorf("orders sequence: %w", err)
+	}
+	if err := dedupeOrderIDs(coll); err != nil {
+		return fmt.Errorf("dedupe order ids: %w", err)
+	}
+
+	_, err = coll.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "createdat", Value: -1}, {Key: "id", Value: -1}}},
+		{Keys: bson.D{{Key: "userid", Value: 1}, {Key: "createdat", Value: -1}, {Key: "id", Value: -1}}},
+		{Keys: bson.D{{Key: "carid", Value: 1}, {Key: "createdat", Value: -1}, {Key: "id", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdat", Value: -1}, {Key: "id", Value: -1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("create indexes: %w", err)
+	}
+	return nil
+}
+
+// dedupeOrderIDs repairs databases written before IDs came from the
+// persistent sequence, when every restart handed out 1, 2, 3... again. Of
+// the orders sharing an id the oldest document keeps it; the others get a
+// fresh sequence ID, which is logged so it can be passed on to the user.
+func dedupeOrderIDs(coll *mongo.Collection) error {
+	cursor, err := coll.Aggregate(context.TODO(), mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$id", "docs": bson.M{"$push": "$_id"}, "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	})
+	if err != nil {
+		return err
+	}
+	var groups []struct {
+		ID   int   `bson:"_id"`
+		Docs []any `bson:"docs"`
+	}
+	if err := cursor.All(context.TODO(), &groups); err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		for _, docID := range g.Docs[1:] {
+			newID, err := infrastructure.NextSequence(context.TODO(), "orders")
+			if err != nil {
+				return err
+			}
+			if _, err := coll.UpdateOne(context.TODO(), bson.M{"_id": docID}, bson.M{"$set": bson.M{"id": newID}}); err != nil {
+				return err
+			}
+			log.Printf("[ORDERS] duplicate order id %d: document %v renumbered to %d", g.ID, docID, newID)
+		}
+	}
+	return nil
+}
+
+// nextOrderID hands out IDs from an in-process counter in memory mode and
+// from the persistent "orders" sequence in MongoDB mode, so IDs stay unique
+// across restarts and between replicas.
+func (r *OrderRepository) nextOrderID() (int, error) {
+	if r.useMemory() {
+		return int(atomic.AddInt64(&r.nextID, 1)), nil
+	}
+	return infrastructure.NextSequence(context.TODO(), "orders")
+}
+
 func (r *OrderRepository) Create(order models.Order) (models.Order, error) {
-	order.ID = int(atomic.AddInt64(&r.nextID, 1))
+	id, err := r.nextOrderID()
+	if err != nil {
+		return models.Order{}, err
+	}
+	order.ID = id
 	order.CreatedAt = time.Now().UTC()
 	order.UpdatedAt = order.CreatedAt
 	if order.Status == "" {
@@ -43,7 +141,7 @@ func (r *OrderRepository) Create(order models.Order) (models.Order, error) {
 		return order, nil
 	}
 
-	_, err := infrastructure.Database.Collection("orders").InsertOne(context.TODO(), order)
+	_, err = infrastructure.Database.Collection("orders").InsertOne(context.TODO(), order)
 	if err != nil {
 		return models.Order{}, err
 	}
@@ -56,7 +154,7 @@ func (r *OrderRepository) GetByID(id int) (models.Order, error) {
 		order, ok := r.items[id]
 		r.mu.RUnlock()
 		if !ok {
-			return models.Order{}, errors.New("order not found")
+			return models.Order{}, ErrNotFound
 		}
 		return order, nil
 	}
@@ -67,93 +165,73 @@ func (r *OrderRepository) GetByID(id int) (models.Order, error) {
 		bson.M{"id": id},
 	).Decode(&order)
 	if err != nil {
-		return models.Order{}, errors.New("order not found")
+		return models.Order{}, ErrNotFound
 	}
 	return order, nil
 }
 
+// GetAll returns every order, newest first.
 func (r *OrderRepository) GetAll() ([]models.Order, error) {
-	if r.useMemory() {
-		r.mu.RLock()
-		orders := make([]models.Order, 0, len(r.items))
-		for _, order := range r.items {
-			orders = append(orders, order)
-		}
-		r.mu.RUnlock()
-		sortOrdersByCreatedDesc(orders)
-		return orders, nil
-	}
-
-	cursor, err := infrastructure.Database.Collection("orders").Find(
-		context.TODO(),
-		bson.M{},
-		options.Find().SetSort(bson.M{"createdat": -1}),
-	)
-	if err != nil {
-		return nil, err
-	}
-	var orders []models.Order
-	if err = cursor.All(context.TODO(), &orders); err != nil {
-		return nil, err
-	}
-	return orders, nil
-}
-
-func (r *OrderRepository) GetByUserID(userID int) ([]models.Order, error) {
-	if r.useMemory() {
-		r.mu.RLock()
-		orders := make([]models.Order, 0)
-		for _, order := range r.items {
-			if order.UserID == userID {
-				orders = append(orders, order)
-			}
-		}
-		r.mu.RUnlock()
-		sortOrdersByCreatedDesc(orders)
-		return orders, nil
-	}
-
-	cursor, err := infrastructure.Database.Collection("orders").Find(
-		context.TODO(),
-		bson.M{"userid": userID},
-		options.Find().SetSort(bson.M{"createdat": -1}),
-	)
+	page, err := r.Find(OrderQuery{})
 	if err != nil {
 		return nil, err
 	}
-	var orders []models.Order
-	return orders, cursor.All(context.TODO(), &orders)
+	return page.Items, nil
 }
 
-func (r *OrderRepository) UpdateStatus(id int, status string) (models.Order, error) {
+// Update applies updateFn to the current order and stores the result. In
+// MongoDB mode the write only succeeds if the order was not changed since it
+// was read; otherwise updateFn is re-run against the fresh document, so
+// checks made inside it (such as status transitions) are never bypassed.
+func (r *OrderRepository) Update(id int, updateFn func(models.Order) (models.Order, error)) (models.Order, error) {
 	if r.useMemory() {
 		r.mu.Lock()
-		order, ok := r.items[id]
+		defer r.mu.Unlock()
+		current, ok := r.items[id]
 		if !ok {
-			r.mu.Unlock()
-			return models.Order{}, errors.New("order not found")
+			return models.Order{}, ErrNotFound
+		}
+		order, err := updateFn(current)
+		if err != nil {
+			return models.Order{}, err
 		}
-		order.Status = status
+		order.ID = current.ID
+		order.CreatedAt = current.CreatedAt
 		order.UpdatedAt = time.Now().UTC()
 		r.items[id] = order
-		r.mu.Unlock()
 		return order, nil
 	}
 
-	var order models.Order
-	err := infrastructure.Database.Collection("orders").FindOne(
-		context.TODO(), bson.M{"id": id},
-	).Decode(&order)
-	if err != nil {
-		return models.Order{}, errors.New("order not found")
-	}
+	for i := 0; i < maxUpdateRetries; i++ {
+		var current models.Order
+		err := infrastructure.Database.Collection("orders").FindOne(
+			context.TODO(), bson.M{"id": id},
+		).Decode(&current)
+		if err != nil {
+			return models.Order{}, ErrNotFound
+		}
 
-	order.Status = status
-	order.UpdatedAt = time.Now().UTC()
-	_, err = infrastructure.Database.Collection("orders").ReplaceOne(
-		context.TODO(), bson.M{"id": id}, order,
-	)
-	return order, err
+		order, err := updateFn(current)
+		if err != nil {
+			return models.Order{}, err
+		}
+		order.ID = current.ID
+		order.CreatedAt = current.CreatedAt
+		order.UpdatedAt = time.Now().UTC()
+
+		result, err := infrastructure.Database.Collection("orders").ReplaceOne(
+			context.TODO(),
+			bson.M{"id": id, "status": current.Status, "updatedat": current.UpdatedAt},
+			order,
+		)
+		if err != nil {
+			return models.Order{}, err
+		}
+		if result.MatchedCount == 1 {
+			return order, nil
+		}
+	}
+	return models.Order{}, errors.New("order was modified concurrently")
 }
 
 func (r *OrderRepository) Delete(id int) error {
@@ -161,7 +239,7 @@ func (r *OrderRepository) Delete(id int) error {
 		r.mu.Lock()
 		defer r.mu.Unlock()
 		if _, ok := r.items[id]; !ok {
-			return errors.New("order not found")
+			return ErrNotFound
 		}
 		delete(r.items, id)
 		return nil
@@ -175,83 +253,7 @@ func (r *OrderRepository) Delete(id int) error {
 		return err
 	}
 	if result.DeletedCount == 0 {
-		return errors.New("order not found")
+		return ErrNotFound
 	}
 	return nil
 }
-
-func (r *OrderRepository) GetByStatus(status string) ([]models.Order, error) {
-	if r.useMemory() {
-		r.mu.RLock()
-		orders := make([]models.Order, 0)
-		for _, order := range r.items {
-			if order.Status == status {
-				orders = append(orders, order)
-			}
-		}
-		r.mu.RUnlock()
-		sortOrdersByCreatedDesc(orders)
-		return orders, nil
-	}
-
-	cursor, err := infrastructure.Database.Collection("orders").Find(
-		context.TODO(),
-		bson.M{"status": status},
-		options.Find().SetSort(bson.M{"createdat": -1}),
-	)
-	if err != nil {
-		return nil, err
-	}
-	var orders []models.Order
-	return orders, cursor.All(context.TODO(), &orders)
-}
-
-func (r *OrderRepository) GetRecent(limit int) ([]models.Order, error) {
-	if r.useMemory() {
-		all, err := r.GetAll()
-		if err != nil {
-			return nil, err
-		}
-		if len(all) > limit {
-			all = all[:limit]
-		}
-		return all, nil
-	}
-
-	cursor, err := infrastructure.Database.Collection("orders").Find(
-		context.TODO(),
-		bson.M{},
-		options.Find().SetSort(bson.M{"createdat": -1}).SetLimit(int64(limit)),
-	)
-	if err != nil {
-		return nil, err
-	}
-	var orders []models.Order
-	return orders, cursor.All(context.TODO(), &orders)
-}
-
-func (r *OrderRepository) Search(query string) ([]models.Order, error) {
-	allOrders, err := r.GetAll()
-	if err != nil {
-		return nil, err
-	}
-
-	var orders []models.Order
-	for _, order := range allOrders {
-		if strings.Contains(strings.ToLower(order.Comment), query) {
-			orders = append(orders, order)
-		}
-	}
-
-	return orders, nil
-}
-
-func sortOrdersByCreatedDesc(orders []models.Order) {
-	for i := 0; i < len(orders)-1; i++ {
-		for j := i + 1; j < len(orders); j++ {
-			if orders[j].CreatedAt.After(orders[i].CreatedAt) {
-				orders[i], orders[j] = orders[j], orders[i]
-			}
-		}
-	}
-}
@@ -0,0 +1,25 @@
+package services
+
+import "errors"
+
+var (
+	ErrCarNotFound    = errors.New("car not found")
+	ErrCarUnavailable = errors.New("car is not available")
+)
+
+// CarInfo is what processing steps need to know about a car.
+type CarInfo struct {
+	Status string
+	Price  int
+}
+
+// CarInventory is the part of the cars module the order service depends on.
+// Reserve must fail with ErrCarNotFound or ErrCarUnavailable when the car
+// cannot be ordered; Release and MarkSold are called when an order is
+// cancelled or completed. Lookup fails with ErrCarNotFound for unknown cars.
+type CarInventory interface {
+	Reserve(carID int) error
+	Release(carID int) error
+	MarkSold(carID int) error
+	Lookup(carID int) (CarInfo, error)
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"AdvancedProgramming/internal/orders/models"
+	"AdvancedProgramming/internal/orders/repositories"
+)
+
+const (
+	DecisionApprove = "approve"
+	DecisionReject  = "reject"
+	DecisionHold    = "hold"
+)
+
+// StepResult is the verdict of one processing step. Reason explains a
+// reject or hold and is shown to admins.
+type StepResult struct {
+	Decision string
+	Reason   string
+}
+
+func approve() StepResult { return StepResult{Decision: DecisionApprove} }
+
+func reject(format string, args ...any) StepResult {
+	return StepResult{Decision: DecisionReject, Reason: fmt.Sprintf(format, args...)}
+}
+
+func hold(format string, args ...any) StepResult {
+	return StepResult{Decision: DecisionHold, Reason: fmt.Sprintf(format, args...)}
+}
+
+// ProcessingStep is one automatic check a pending order must pass before it
+// is confirmed. Returning an error means the check itself could not run; the
+// job is then retried instead of deciding on the order.
+type ProcessingStep interface {
+	Name() string
+	Check(order models.Order) (StepResult, error)
+}
+
+// Pipeline runs registered steps in registration order. The first step that
+// does not approve decides the outcome.
+type Pipeline struct {
+	mu    sync.RWMutex
+	steps []ProcessingStep
+}
+
+func NewPipeline(steps ...ProcessingStep) *Pipeline {
+	return &Pipeline{steps: steps}
+}
+
+func (p *Pipeline) Register(step ProcessingStep) {
+	p.mu.Lock()
+	p.steps = append(p.steps, step)
+	p.mu.Unlock()
+}
+
+// Run checks the order against every step and returns the outcome to store
+// on it.
+func (p *Pipeline) Run(order models.Order) (models.ProcessingResult, error) {
+	p.mu.RLock()
+	steps := append([]ProcessingStep(nil), p.steps...)
+	p.mu.RUnlock()
+
+	for _, step := range steps {
+		res, err := step.Check(order)
+		if err != nil {
+			return models.ProcessingResult{}, fmt.Errorf("%s: %w", step.Name(), err)
+		}
+		if res.Decision != DecisionApprove {
+			return models.ProcessingResult{
+				Decision: res.Decision,
+				Step:     step.Name(),
+				Reason:   res.Reason,
+				At:       time.Now().UTC(),
+			}, nil
+		}
+	}
+	return models.ProcessingResult{Decision: DecisionApprove, At: time.Now().UTC()}, nil
+}
+
+// DefaultPipeline returns the checks every order goes through.
+func DefaultPipeline(cars CarInventory, repo *repositories.OrderRepository) *Pipeline {
+	return NewPipeline(
+		CarAvailabilityStep{Cars: cars},
+		DepositStep{Cars: cars, ManualReviewAbove: 50000},
+		FraudStep{Repo: repo, Window: 24 * time.Hour, HoldAbove: 3, RejectAbove: 10},
+	)
+}
+
+// CarAvailabilityStep rejects orders whose car was deleted and holds orders
+// whose car is no longer reserved, e.g. after an admin edited its status.
+type CarAvailabilityStep struct {
+	Cars CarInventory
+}
+
+func (CarAvailabilityStep) Name() string { return "car_availability" }
+
+func (s CarAvailabilityStep) Check(order models.Order) (StepResult, error) {
+	car, err := s.Cars.Lookup(order.CarID)
+	if errors.Is(err, ErrCarNotFound) {
+		return reject("car %d no longer exists", order.CarID), nil
+	}
+	if err != nil {
+		return StepResult{}, err
+	}
+	if car.Status != "reserved" {
+		return hold("car %d is %s, expected reserved", order.CarID, car.Status), nil
+	}
+	return approve(), nil
+}
+
+// DepositStep holds orders for expensive cars until an admin has verified
+// the customer's deposit or credit approval.
+type DepositStep struct {
+	Cars              CarInventory
+	ManualReviewAbove int
+}
+
+func (DepositStep) Name() string { return "deposit_check" }
+
+func (s DepositStep) Check(order models.Order) (StepResult, error) {
+	car, err := s.Cars.Lookup(order.CarID)
+	if err != nil {
+		return StepResult{}, err
+	}
+	if car.Price > s.ManualReviewAbove {
+		return hold("price %d exceeds %d, deposit must be verified manually", car.Price, s.ManualReviewAbove), nil
+	}
+	return approve(), nil
+}
+
+// FraudStep flags users who place many orders in a short time: above
+// HoldAbove orders within Window the order is held, above RejectAbove it is
+// rejected. The count covers the order itself and the user's orders placed
+// in the Window before it, so retrying or resuming the job later gives the
+// same answer.
+type FraudStep struct {
+	Repo        *repositories.OrderRepository
+	Window      time.Duration
+	HoldAbove   int
+	RejectAbove int
+}
+
+func (FraudStep) Name() string { return "fraud_heuristic" }
+
+func (s FraudStep) Check(order models.Order) (StepResult, error) {
+	// CreatedTo is exclusive, which leaves out the order itself and every
+	// order placed after it
+	page, err := s.Repo.Find(repositories.OrderQuery{
+		UserID:      order.UserID,
+		CreatedFrom: order.CreatedAt.Add(-s.Window),
+		CreatedTo:   order.CreatedAt,
+		Limit:       1,
+	})
+	if err != nil {
+		return StepResult{}, err
+	}
+	count := page.Total + 1
+	switch {
+	case count > s.RejectAbove:
+		return reject("user %d placed %d orders within %s", order.UserID, count, s.Window), nil
+	case count > s.HoldAbove:
+		return hold("user %d placed %d orders within %s", order.UserID, count, s.Window), nil
+	}
+	return approve(), nil
+}
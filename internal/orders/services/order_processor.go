@@ -0,0 +1,208 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"AdvancedProgramming/internal/orders/models"
+	"AdvancedProgramming/internal/orders/queue"
+	"AdvancedProgramming/internal/orders/repositories"
+)
+
+// ActorProcessor is recorded in the order history for changes made by the
+// background processor.
+const ActorProcessor = "system:processor"
+
+const (
+	// processingDelay is how long a new order stays pending before the
+	// background processor runs the pipeline on it.
+	processingDelay = 3 * time.Second
+
+	// jobVisibility is how long a claimed job stays hidden from other
+	// workers. A worker that dies mid-job loses it after this timeout.
+	jobVisibility = 30 * time.Second
+
+	// jobPollInterval is how often the processor looks for due jobs when it
+	// has not been notified, e.g. jobs enqueued by another replica.
+	jobPollInterval = time.Second
+
+	maxJobAttempts = 5
+	retryBaseDelay = 2 * time.Second
+	retryMaxDelay  = time.Minute
+)
+
+// enqueue schedules an order for processing. The job is stored in the queue,
+// so it survives restarts; errors are only logged because resumePending
+// picks up any pending order without a job on the next boot.
+func (s *OrderService) enqueue(order models.Order) {
+	if err := s.jobs.Enqueue(order.ID, order.CreatedAt.Add(processingDelay)); err != nil {
+		log.Printf("❌ Failed to queue order %d: %v", order.ID, err)
+		return
+	}
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// resumePending queues every pending order. Orders that already have a job
+// keep it, so this only fills gaps left by a crash or an older version.
+func (s *OrderService) resumePending() {
+	page, err := s.repo.Find(repositories.OrderQuery{Status: StatusPending})
+	if err != nil {
+		log.Printf("❌ Failed to load pending orders: %v", err)
+		return
+	}
+	for _, order := range page.Items {
+		s.enqueue(order)
+	}
+	if len(page.Items) > 0 {
+		log.Printf("📦 Resumed processing for %d pending orders", len(page.Items))
+	}
+}
+
+func (s *OrderService) backgroundProcessor() {
+	defer close(s.processorDone)
+	log.Println("📦 Order background processor started")
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		job, ok, err := s.jobs.Dequeue(jobVisibility)
+		if err != nil {
+			log.Printf("❌ Failed to fetch order job: %v", err)
+		}
+		if err != nil || !ok {
+			select {
+			case <-s.notify:
+			case <-time.After(jobPollInterval):
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		s.runJob(job)
+	}
+}
+
+func (s *OrderService) runJob(job queue.Job) {
+	log.Printf("⏳ Processing order %d (attempt %d) ...", job.OrderID, job.Attempts)
+
+	var err error
+	if job.Attempts > maxJobAttempts {
+		// the previous worker ran out of visibility time on the last attempt
+		err = errors.New("attempts exhausted")
+	} else {
+		err = s.processOrder(job.OrderID)
+	}
+
+	switch {
+	case err == nil:
+		err = s.jobs.Complete(job)
+	case job.Attempts >= maxJobAttempts:
+		log.Printf("☠️ Order %d moved to dead-letter: %v", job.OrderID, err)
+		err = s.jobs.DeadLetter(job, err.Error())
+	default:
+		delay := retryDelay(job.Attempts)
+		log.Printf("🔁 Order %d failed, retrying in %s: %v", job.OrderID, delay, err)
+		err = s.jobs.Retry(job, time.Now().Add(delay), err.Error())
+	}
+	if err != nil {
+		log.Printf("❌ Failed to update job for order %d: %v", job.OrderID, err)
+	}
+}
+
+// retryDelay doubles the wait after every failed attempt, up to
+// retryMaxDelay.
+func retryDelay(attempts int) time.Duration {
+	d := retryBaseDelay
+	for i := 1; i < attempts && d < retryMaxDelay; i++ {
+		d *= 2
+	}
+	if d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return d
+}
+
+// RegisterStep appends a check to the processing pipeline.
+func (s *OrderService) RegisterStep(step ProcessingStep) {
+	s.pipeline.Register(step)
+}
+
+// processOrder runs the pipeline on a pending order and confirms, cancels or
+// holds it accordingly. Orders that were cancelled or deleted in the
+// meantime need no work and are not treated as failures.
+func (s *OrderService) processOrder(orderID int) error {
+	order, err := s.repo.GetByID(orderID)
+	if errors.Is(err, repositories.ErrNotFound) {
+		log.Printf("⏭️ Order %d no longer exists, skipping processing", orderID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if order.Status != StatusPending {
+		log.Printf("⏭️ Order %d is already %s, skipping processing", orderID, order.Status)
+		return nil
+	}
+
+	result, err := s.pipeline.Run(order)
+	if err != nil {
+		return fmt.Errorf("pipeline: %w", err)
+	}
+
+	status := StatusConfirmed
+	switch result.Decision {
+	case DecisionReject:
+		status = StatusCancelled
+	case DecisionHold:
+		status = StatusOnHold
+	}
+
+	reason := result.Reason
+	if result.Step != "" {
+		reason = result.Step + ": " + reason
+	}
+	_, err = s.transition(orderID, status, ActorProcessor, reason, &result)
+	var terr *TransitionError
+	switch {
+	case errors.As(err, &terr):
+		// changed by someone else while the pipeline ran
+		log.Printf("⏭️ Order %d is already %s, skipping processing", orderID, terr.From)
+		return nil
+	case errors.Is(err, repositories.ErrNotFound):
+		log.Printf("⏭️ Order %d no longer exists, skipping processing", orderID)
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if result.Reason != "" {
+		log.Printf("🛑 Order %d %s by %s: %s", orderID, status, result.Step, result.Reason)
+	} else {
+		log.Printf("✅ Order %d automatically confirmed", orderID)
+	}
+	return nil
+}
+
+// Close stops the background processor after the job in progress, if any,
+// finishes. Queued jobs stay in the queue and are picked up on the next
+// start.
+func (s *OrderService) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() { close(s.done) })
+
+	select {
+	case <-s.processorDone:
+		log.Println("📦 Order background processor stopped")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
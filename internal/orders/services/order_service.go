@@ -1,115 +1,265 @@
 package services
 
 import (
+	"AdvancedProgramming/internal/httpx"
 	"AdvancedProgramming/internal/orders/models"
+	"AdvancedProgramming/internal/orders/queue"
 	"AdvancedProgramming/internal/orders/repositories"
 	"errors"
+	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	DefaultPageLimit = 20
+	MaxPageLimit     = 100
+)
+
+var (
+	ErrInvalidQuery   = errors.New("invalid query")
+	ErrInvalidOrderID = errors.New("invalid order id")
+	ErrInvalidUserID  = errors.New("invalid user id")
+)
+
 type OrderService struct {
 	repo          *repositories.OrderRepository
-	processChan   chan int
+	cars          CarInventory
 	validStatuses map[string]bool
+
+	// order processing, see order_processor.go
+	pipeline      *Pipeline
+	jobs          queue.Queue
+	notify        chan struct{}
+	done          chan struct{}
+	closeOnce     sync.Once
+	processorDone chan struct{}
 }
 
-func NewOrderService(repo *repositories.OrderRepository) *OrderService {
+func NewOrderService(repo *repositories.OrderRepository, cars CarInventory, jobs queue.Queue) *OrderService {
 	s := &OrderService{
-		repo:        repo,
-		processChan: make(chan int, 10),
+		repo:     repo,
+		cars:     cars,
+		jobs:     jobs,
+		pipeline: DefaultPipeline(cars, repo),
 		validStatuses: map[string]bool{
-			"pending":   true,
-			"confirmed": true,
-			"cancelled": true,
-			"completed": true,
+			StatusPending:   true,
+			StatusOnHold:    true,
+			StatusConfirmed: true,
+			StatusCancelled: true,
+			StatusCompleted: true,
 		},
+		notify:        make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		processorDone: make(chan struct{}),
 	}
+	s.resumePending()
 	go s.backgroundProcessor()
 	return s
 }
 
-func (s *OrderService) backgroundProcessor() {
-	log.Println("📦 Order background processor started")
-	for orderID := range s.processChan {
-		log.Printf("⏳ Processing order %d ...", orderID)
-		time.Sleep(3 * time.Second)
-
-		_, err := s.repo.UpdateStatus(orderID, "confirmed")
-		if err != nil {
-			log.Printf("❌ Failed to auto-confirm order %d: %v", orderID, err)
-		} else {
-			log.Printf("✅ Order %d automatically confirmed", orderID)
-		}
-	}
-}
-
-func (s *OrderService) CreateOrder(userID, carID int, comment string) (models.Order, error) {
+func (s *OrderService) CreateOrder(userID, carID int, comment, actor string) (models.Order, error) {
+	var verr httpx.ValidationError
 	if userID <= 0 {
-		return models.Order{}, errors.New("user_id must be positive")
+		verr.Add("user_id", "invalid", "user_id must be positive")
 	}
 	if carID <= 0 {
-		return models.Order{}, errors.New("car_id must be positive")
+		verr.Add("car_id", "invalid", "car_id must be positive")
 	}
 
 	comment = strings.TrimSpace(comment)
 	if len(comment) == 0 {
-		return models.Order{}, errors.New("comment cannot be empty")
+		verr.Add("comment", "required", "comment cannot be empty")
 	}
 	if len(comment) > 500 {
-		return models.Order{}, errors.New("comment too long (max 500 characters)")
+		verr.Add("comment", "too_long", "comment too long (max 500 characters)")
+	}
+	if err := verr.Err(); err != nil {
+		return models.Order{}, err
 	}
 
 	order := models.Order{
 		UserID:  userID,
 		CarID:   carID,
 		Comment: comment,
-		Status:  "pending",
+	}
+	recordChange(&order, StatusPending, actor, "")
+
+	if err := s.cars.Reserve(carID); err != nil {
+		return models.Order{}, err
 	}
 
 	created, err := s.repo.Create(order)
 	if err != nil {
+		if relErr := s.cars.Release(carID); relErr != nil {
+			log.Printf("❌ Failed to release car %d after order create error: %v", carID, relErr)
+		}
 		return models.Order{}, err
 	}
 
-	go func() { s.processChan <- created.ID }()
+	s.enqueue(created)
 	return created, nil
 }
 
 func (s *OrderService) GetOrder(id int) (models.Order, error) {
 	if id <= 0 {
-		return models.Order{}, errors.New("invalid order id")
+		return models.Order{}, ErrInvalidOrderID
 	}
 	return s.repo.GetByID(id)
 }
 
-func (s *OrderService) GetAllOrders() ([]models.Order, error) {
-	return s.repo.GetAll()
+// ListOrders returns one page of orders matching q, newest first.
+func (s *OrderService) ListOrders(q repositories.OrderQuery) (repositories.OrderPage, error) {
+	if q.Status != "" && !s.validStatuses[q.Status] {
+		return repositories.OrderPage{}, fmt.Errorf("%w: invalid status", ErrInvalidQuery)
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultPageLimit
+	}
+	if q.Limit > MaxPageLimit {
+		return repositories.OrderPage{}, fmt.Errorf("%w: limit must be at most %d", ErrInvalidQuery, MaxPageLimit)
+	}
+	return s.repo.Find(q)
 }
 
-func (s *OrderService) GetUserOrders(userID int) ([]models.Order, error) {
+func (s *OrderService) GetUserOrders(userID int, q repositories.OrderQuery) (repositories.OrderPage, error) {
 	if userID <= 0 {
-		return nil, errors.New("invalid user id")
+		return repositories.OrderPage{}, ErrInvalidUserID
+	}
+	q.UserID = userID
+	return s.ListOrders(q)
+}
+
+// GetUserOrder returns the order only if it belongs to userID. Orders owned
+// by someone else are reported as not found.
+func (s *OrderService) GetUserOrder(userID, id int) (models.Order, error) {
+	order, err := s.GetOrder(id)
+	if err != nil {
+		return models.Order{}, err
+	}
+	if order.UserID != userID {
+		return models.Order{}, repositories.ErrNotFound
+	}
+	return order, nil
+}
+
+// CancelUserOrder lets a customer cancel their own order while it is still
+// pending.
+func (s *OrderService) CancelUserOrder(userID, id int, actor string) (models.Order, error) {
+	if id <= 0 {
+		return models.Order{}, ErrInvalidOrderID
+	}
+	order, err := s.repo.Update(id, func(order models.Order) (models.Order, error) {
+		if order.UserID != userID {
+			return models.Order{}, repositories.ErrNotFound
+		}
+		if order.Status != StatusPending {
+			return models.Order{}, ErrCancelNotAllowed
+		}
+		recordChange(&order, StatusCancelled, actor, "cancelled by customer")
+		return order, nil
+	})
+	if err != nil {
+		return models.Order{}, err
 	}
-	return s.repo.GetByUserID(userID)
+	s.syncCar(order)
+	return order, nil
 }
 
-func (s *OrderService) UpdateStatus(id int, status string) (models.Order, error) {
+func (s *OrderService) UpdateStatus(id int, status, actor, reason string) (models.Order, error) {
 	if id <= 0 {
-		return models.Order{}, errors.New("invalid order id")
+		return models.Order{}, ErrInvalidOrderID
 	}
 	if !s.validStatuses[status] {
-		return models.Order{}, errors.New("invalid status. allowed: pending, confirmed, cancelled, completed")
+		verr := httpx.ValidationError{}
+		verr.Add("status", "invalid", "invalid status. allowed: pending, on_hold, confirmed, cancelled, completed")
+		return models.Order{}, &verr
+	}
+	return s.transition(id, status, actor, strings.TrimSpace(reason), nil)
+}
+
+// GetOrderHistory returns the status changes of an order, oldest first.
+func (s *OrderService) GetOrderHistory(id int) ([]models.StatusChange, error) {
+	order, err := s.GetOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	if order.History == nil {
+		return []models.StatusChange{}, nil
+	}
+	return order.History, nil
+}
+
+// transition moves the order to status if the transition graph allows it,
+// returning a *TransitionError otherwise. The change is appended to the
+// order history; a non-nil result is stored as the processing outcome.
+func (s *OrderService) transition(id int, status, actor, reason string, result *models.ProcessingResult) (models.Order, error) {
+	order, err := s.repo.Update(id, func(order models.Order) (models.Order, error) {
+		if !canTransition(order.Status, status) {
+			return models.Order{}, &TransitionError{OrderID: id, From: order.Status, To: status}
+		}
+		recordChange(&order, status, actor, reason)
+		if result != nil {
+			order.Processing = result
+		}
+		return order, nil
+	})
+	if err != nil {
+		return models.Order{}, err
+	}
+	s.syncCar(order)
+	return order, nil
+}
+
+// recordChange sets the order status and appends the change to its history.
+func recordChange(order *models.Order, to, actor, reason string) {
+	order.History = append(order.History, models.StatusChange{
+		From:   order.Status,
+		To:     to,
+		Actor:  actor,
+		Reason: reason,
+		At:     time.Now().UTC(),
+	})
+	order.Status = to
+}
+
+// syncCar keeps the ordered car's status in line with the order: cancelled
+// orders release the car and completed orders mark it sold.
+func (s *OrderService) syncCar(order models.Order) {
+	var err error
+	switch order.Status {
+	case StatusCancelled:
+		err = s.cars.Release(order.CarID)
+	case StatusCompleted:
+		err = s.cars.MarkSold(order.CarID)
+	default:
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to update car %d for order %d (%s): %v", order.CarID, order.ID, order.Status, err)
 	}
-	return s.repo.UpdateStatus(id, status)
 }
 
 func (s *OrderService) DeleteOrder(id int) error {
 	if id <= 0 {
-		return errors.New("invalid order id")
+		return ErrInvalidOrderID
+	}
+	order, err := s.repo.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.Delete(id); err != nil {
+		return err
 	}
-	return s.repo.Delete(id)
+	if order.Status == StatusPending || order.Status == StatusOnHold || order.Status == StatusConfirmed {
+		if err := s.cars.Release(order.CarID); err != nil {
+			log.Printf("❌ Failed to release car %d for deleted order %d: %v", order.CarID, id, err)
+		}
+	}
+	return nil
 }
 
 // НОВЫЕ МЕТОДЫ ДЛЯ УЛУЧШЕНИЯ:
@@ -117,9 +267,10 @@ func (s *OrderService) DeleteOrder(id int) error {
 // GetOrdersByStatus - фильтр по статусу
 func (s *OrderService) GetOrdersByStatus(status string) ([]models.Order, error) {
 	if !s.validStatuses[status] {
-		return nil, errors.New("invalid status")
+		return nil, fmt.Errorf("%w: invalid status", ErrInvalidQuery)
 	}
-	return s.repo.GetByStatus(status)
+	page, err := s.repo.Find(repositories.OrderQuery{Status: status})
+	return page.Items, err
 }
 
 // GetRecentOrders - последние N заказов
@@ -127,7 +278,8 @@ func (s *OrderService) GetRecentOrders(limit int) ([]models.Order, error) {
 	if limit <= 0 || limit > 100 {
 		limit = 10
 	}
-	return s.repo.GetRecent(limit)
+	page, err := s.repo.Find(repositories.OrderQuery{Limit: limit})
+	return page.Items, err
 }
 
 // GetOrderStats - статистика по заказам
@@ -140,6 +292,7 @@ func (s *OrderService) GetOrderStats() (map[string]interface{}, error) {
 	stats := map[string]interface{}{
 		"total":     len(allOrders),
 		"pending":   0,
+		"on_hold":   0,
 		"confirmed": 0,
 		"cancelled": 0,
 		"completed": 0,
@@ -167,14 +320,13 @@ func (s *OrderService) GetOrderStats() (map[string]interface{}, error) {
 		topCars = append(topCars, carStat{CarID: carID, Count: count})
 	}
 
-	// Сортировка по количеству (простая)
-	for i := 0; i < len(topCars)-1; i++ {
-		for j := i + 1; j < len(topCars); j++ {
-			if topCars[j].Count > topCars[i].Count {
-				topCars[i], topCars[j] = topCars[j], topCars[i]
-			}
+	// Сортировка по количеству
+	sort.Slice(topCars, func(i, j int) bool {
+		if topCars[i].Count != topCars[j].Count {
+			return topCars[i].Count > topCars[j].Count
 		}
-	}
+		return topCars[i].CarID < topCars[j].CarID
+	})
 
 	if len(topCars) > 5 {
 		topCars = topCars[:5]
@@ -195,9 +347,10 @@ func (s *OrderService) GetOrderStats() (map[string]interface{}, error) {
 }
 
 // SearchOrders - поиск по комментарию
-func (s *OrderService) SearchOrders(query string) ([]models.Order, error) {
+func (s *OrderService) SearchOrders(query string, q repositories.OrderQuery) (repositories.OrderPage, error) {
 	if len(query) < 2 {
-		return nil, errors.New("search query too short (min 2 characters)")
+		return repositories.OrderPage{}, fmt.Errorf("%w: search query too short (min 2 characters)", ErrInvalidQuery)
 	}
-	return s.repo.Search(strings.ToLower(query))
+	q.Comment = query
+	return s.ListOrders(q)
 }
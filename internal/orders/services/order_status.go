@@ -0,0 +1,50 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusOnHold    = "on_hold"
+	StatusConfirmed = "confirmed"
+	StatusCancelled = "cancelled"
+	StatusCompleted = "completed"
+)
+
+// orderTransitions lists the statuses each status may move to. Completed and
+// cancelled orders are terminal and have no outgoing edges. Orders go on hold
+// when a processing step needs a human decision.
+var orderTransitions = map[string][]string{
+	StatusPending:   {StatusConfirmed, StatusCancelled, StatusOnHold},
+	StatusOnHold:    {StatusConfirmed, StatusCancelled},
+	StatusConfirmed: {StatusCompleted, StatusCancelled},
+	StatusCancelled: {},
+	StatusCompleted: {},
+}
+
+// ErrCancelNotAllowed is returned when a customer tries to cancel an order
+// that has already left the pending state.
+var ErrCancelNotAllowed = errors.New("only pending orders can be cancelled")
+
+// TransitionError is returned when an order cannot move from its current
+// status to the requested one.
+type TransitionError struct {
+	OrderID int
+	From    string
+	To      string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order %d cannot change status from %s to %s", e.OrderID, e.From, e.To)
+}
+
+func canTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
@@ -1,7 +1,9 @@
 package webui
 
 import (
+	"errors"
 	"html/template"
+	"log"
 	"net/http"
 	"path/filepath"
 	"strconv"
@@ -9,6 +11,7 @@ import (
 
 	"AdvancedProgramming/internal/auth"
 	"AdvancedProgramming/internal/cars"
+	"AdvancedProgramming/internal/httpx"
 )
 
 type Handler struct {
@@ -29,6 +32,8 @@ func Register(mux *http.ServeMux, carService *cars.Service) {
 	mux.HandleFunc("/ui/cars/new", h.carsNew)
 	mux.HandleFunc("/ui/cars/", h.carsActions)
 	mux.HandleFunc("/ui/orders", h.ordersList)
+	mux.HandleFunc("/ui/favorites", h.favoritesList)
+	mux.HandleFunc("/ui/favorites/", h.favoritesActions)
 	mux.HandleFunc("/ui/login", h.login)
 	mux.HandleFunc("/ui/register", h.register)
 }
@@ -62,16 +67,45 @@ func (h *Handler) carsList(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	h.render(w, "cars_list.html", CarsListView{BaseView: BaseView{Title: "Cars"}, Cars: h.cars.List()})
+	res, err := h.cars.List(cars.ListQuery{})
+	if err != nil {
+		http.Error(w, "failed to load cars", http.StatusInternalServerError)
+		return
+	}
+	h.render(w, "cars_list.html", CarsListView{BaseView: BaseView{Title: "Cars"}, Cars: res.Items})
 }
 
+// CarsNewView re-renders the form with what the user typed and an error
+// message under each field that failed validation.
 type CarsNewView struct {
 	BaseView
-	Error string
+	Error  string
+	Notice string
+	Form   map[string]string
+	Fields map[string]string
+
+	BodyTypes     []cars.BodyType
+	FuelTypes     []cars.FuelType
+	Transmissions []cars.Transmission
+	Drivetrains   []cars.Drivetrain
+	Conditions    []cars.Condition
+}
+
+var carFormFields = []string{
+	"brand", "model", "year", "price", "mileage",
+	"vin", "body_type", "fuel_type", "transmission", "drivetrain",
+	"engine_volume", "engine_power", "color", "owners", "condition", "description",
 }
 
 func (h *Handler) carsNew(w http.ResponseWriter, r *http.Request) {
-	view := CarsNewView{BaseView: BaseView{Title: "Add Car"}}
+	view := CarsNewView{
+		BaseView:      BaseView{Title: "Add Car"},
+		BodyTypes:     cars.BodyTypes,
+		FuelTypes:     cars.FuelTypes,
+		Transmissions: cars.Transmissions,
+		Drivetrains:   cars.Drivetrains,
+		Conditions:    cars.Conditions,
+	}
 	switch r.Method {
 	case http.MethodGet:
 		h.render(w, "cars_new.html", view)
@@ -81,23 +115,123 @@ func (h *Handler) carsNew(w http.ResponseWriter, r *http.Request) {
 			h.render(w, "cars_new.html", view)
 			return
 		}
-		year, _ := strconv.Atoi(r.FormValue("year"))
-		price, _ := strconv.Atoi(r.FormValue("price"))
-		mileage, _ := strconv.Atoi(r.FormValue("mileage"))
-		_, err := h.cars.Create(cars.CreateCarRequest{
-			Brand: r.FormValue("brand"), Model: r.FormValue("model"), Year: year, Price: price, Mileage: mileage,
-		})
-		if err != nil {
-			view.Error = "Validation error. Check fields."
+		view.Form = map[string]string{}
+		for _, f := range carFormFields {
+			view.Form[f] = strings.TrimSpace(r.FormValue(f))
+		}
+
+		if r.FormValue("action") == "decode" {
+			h.decodeVIN(&view)
 			h.render(w, "cars_new.html", view)
 			return
 		}
-		http.Redirect(w, r, "/ui/cars", http.StatusSeeOther)
+
+		var verr httpx.ValidationError
+		number := func(field string) int {
+			n, err := strconv.Atoi(view.Form[field])
+			if err != nil {
+				verr.Add(field, "invalid_type", field+" must be a number")
+			}
+			return n
+		}
+		// the specification is optional, so blank numbers stay zero
+		optional := func(field string) int {
+			if view.Form[field] == "" {
+				return 0
+			}
+			return number(field)
+		}
+		var volume float64
+		if raw := view.Form["engine_volume"]; raw != "" {
+			var err error
+			if volume, err = strconv.ParseFloat(raw, 64); err != nil {
+				verr.Add("engine_volume", "invalid_type", "engine_volume must be a number")
+			}
+		}
+		req := cars.CreateCarRequest{
+			Brand:   view.Form["brand"],
+			Model:   view.Form["model"],
+			Year:    number("year"),
+			Price:   number("price"),
+			Mileage: number("mileage"),
+			Spec: cars.Spec{
+				VIN:          view.Form["vin"],
+				BodyType:     cars.BodyType(view.Form["body_type"]),
+				FuelType:     cars.FuelType(view.Form["fuel_type"]),
+				Transmission: cars.Transmission(view.Form["transmission"]),
+				Drivetrain:   cars.Drivetrain(view.Form["drivetrain"]),
+				EngineVolume: volume,
+				EnginePower:  optional("engine_power"),
+				Color:        view.Form["color"],
+				Owners:       optional("owners"),
+				Condition:    cars.Condition(view.Form["condition"]),
+				Description:  view.Form["description"],
+			},
+		}
+
+		// a field that is not a number keeps that message; the others are
+		// still checked so every problem shows up at once
+		var err error
+		if verr.Err() == nil {
+			if _, err = h.cars.Create(req); err == nil {
+				http.Redirect(w, r, "/ui/cars", http.StatusSeeOther)
+				return
+			}
+		} else {
+			err = cars.ValidateCreate(req)
+		}
+		details := httpx.Details(err)
+		if errors.Is(err, cars.ErrDuplicateVIN) {
+			details = []httpx.FieldError{{Field: "vin", Code: "duplicate", Message: err.Error()}}
+		}
+		if err != nil && details == nil {
+			view.Error = "Failed to create car"
+			h.render(w, "cars_new.html", view)
+			return
+		}
+		verr.Fields = append(verr.Fields, details...)
+
+		view.Error = "Please fix the highlighted fields."
+		view.Fields = map[string]string{}
+		for _, f := range verr.Fields {
+			if _, ok := view.Fields[f.Field]; !ok {
+				view.Fields[f.Field] = f.Message
+			}
+		}
+		h.render(w, "cars_new.html", view)
 	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// decodeVIN fills brand and year from the VIN on the form, keeping what the
+// user already typed.
+func (h *Handler) decodeVIN(view *CarsNewView) {
+	info, err := cars.DecodeVIN(view.Form["vin"])
+	if err != nil {
+		view.Fields = map[string]string{}
+		for _, f := range httpx.Details(err) {
+			view.Fields[f.Field] = f.Message
+		}
+		view.Error = "Could not decode the VIN."
+		return
+	}
+	view.Form["vin"] = info.VIN
+	if view.Form["brand"] == "" {
+		view.Form["brand"] = info.Manufacturer
+	}
+	if view.Form["year"] == "" && info.ModelYear > 0 {
+		view.Form["year"] = strconv.Itoa(info.ModelYear)
+	}
+	view.Notice = "VIN " + info.VIN + ": " + info.Region
+	if info.Manufacturer != "" {
+		view.Notice += ", " + info.Manufacturer
+	}
+	if info.ModelYear > 0 {
+		view.Notice += ", model year " + strconv.Itoa(info.ModelYear)
+	}
+}
+
 func (h *Handler) carsActions(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -162,14 +296,36 @@ func (h *Handler) login(w http.ResponseWriter, r *http.Request) {
 		h.render(w, "auth_login.html", view)
 		return
 	}
-	token, user, err := auth.LoginUser(auth.LoginRequest{Username: r.FormValue("username"), Password: r.FormValue("password")})
+	pair, user, err := auth.LoginUser(auth.LoginRequest{Username: r.FormValue("username"), Password: r.FormValue("password")}, auth.ClientIP(r))
+	var mfa *auth.MFARequiredError
+	if errors.As(err, &mfa) {
+		code := strings.TrimSpace(r.FormValue("code"))
+		if code == "" {
+			view.Error = "Enter the code from your authenticator app or a recovery code"
+			h.render(w, "auth_login.html", view)
+			return
+		}
+		req := auth.MFALoginRequest{MFAToken: mfa.Token, Code: code}
+		if len(code) != 6 {
+			req = auth.MFALoginRequest{MFAToken: mfa.Token, RecoveryCode: code}
+		}
+		pair, user, err = auth.CompleteMFALogin(req, auth.ClientIP(r))
+	}
 	if err != nil {
 		view.Error = err.Error()
 		h.render(w, "auth_login.html", view)
 		return
 	}
 	view.Success = "Welcome, " + user.Username + " (" + string(user.Role) + ")"
-	view.Token = token
+	view.Token = pair.AccessToken
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    pair.AccessToken,
+		Path:     "/ui/",
+		MaxAge:   pair.ExpiresIn,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
 	h.render(w, "auth_login.html", view)
 }
 
@@ -193,15 +349,130 @@ func (h *Handler) register(w http.ResponseWriter, r *http.Request) {
 		role = "admin"
 	}
 	_, err := auth.RegisterUser(auth.RegisterRequest{Username: r.FormValue("username"), Password: r.FormValue("password"), Role: role, AdminKey: r.FormValue("admin_key")})
-	if err != nil {
+	var verr *httpx.ValidationError
+	switch {
+	case err == nil:
+	case errors.As(err, &verr), errors.Is(err, auth.ErrInvalidAdminKey), errors.Is(err, auth.ErrUserExists):
 		view.Error = err.Error()
 		h.render(w, "auth_register.html", view)
 		return
+	default:
+		log.Printf("[AUTH] registration of %q failed: %v", r.FormValue("username"), err)
+		view.Error = "Registration failed, please try again later."
+		h.render(w, "auth_register.html", view)
+		return
 	}
 	view.Success = "Registration successful. You can login now."
 	h.render(w, "auth_register.html", view)
 }
 
+// sessionCookie holds the access token after logging in through the UI.
+// SameSite=Lax keeps other sites from posting the favorites forms with it.
+const sessionCookie = "carstore_token"
+
+// currentUser returns the claims of the UI session, if any.
+func currentUser(r *http.Request) (auth.Claims, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return auth.Claims{}, false
+	}
+	claims, err := auth.Authenticate(c.Value)
+	if err != nil {
+		return auth.Claims{}, false
+	}
+	return claims, true
+}
+
+type FavoritesView struct {
+	BaseView
+	LoggedIn bool
+	Username string
+	Cars     []cars.Car
+	Error    string
+}
+
+func (h *Handler) favoritesList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.renderFavorites(w, r, "")
+}
+
+// renderFavorites shows the favorites page of the logged-in user, with
+// errMsg on top if an action failed.
+func (h *Handler) renderFavorites(w http.ResponseWriter, r *http.Request, errMsg string) {
+	view := FavoritesView{BaseView: BaseView{Title: "Favorites"}, Error: errMsg}
+	claims, ok := currentUser(r)
+	if !ok {
+		h.render(w, "favorites.html", view)
+		return
+	}
+	view.LoggedIn = true
+	view.Username = claims.Username
+
+	items, err := auth.FavoriteItems(claims.Username, h.cars.GetMany)
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		view.Error = "User not found"
+	case err != nil:
+		log.Printf("[FAVORITES] failed to load favorites for %s: %v", claims.Username, err)
+		view.Error = "Failed to load favorites"
+	}
+	view.Cars = items
+	h.render(w, "favorites.html", view)
+}
+
+// favoritesActions handles POST /ui/favorites/{carID}/add and /remove.
+func (h *Handler) favoritesActions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, ok := currentUser(r)
+	if !ok {
+		http.Redirect(w, r, "/ui/login", http.StatusSeeOther)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/ui/favorites/"), "/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || id <= 0 {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	switch parts[1] {
+	case "add":
+		if _, err := h.cars.GetByID(id); err != nil {
+			if errors.Is(err, cars.ErrNotFound) {
+				h.renderFavorites(w, r, "Car "+strconv.Itoa(id)+" was not found.")
+				return
+			}
+			log.Printf("[FAVORITES] failed to load car %d: %v", id, err)
+			h.renderFavorites(w, r, "Could not add the car to your favorites.")
+			return
+		}
+		if _, err := auth.AddFavorite(claims.Username, id); err != nil {
+			log.Printf("[FAVORITES] failed to add car %d for %s: %v", id, claims.Username, err)
+			h.renderFavorites(w, r, "Could not add the car to your favorites.")
+			return
+		}
+	case "remove":
+		if _, err := auth.RemoveFavorite(claims.Username, id); err != nil {
+			log.Printf("[FAVORITES] failed to remove car %d for %s: %v", id, claims.Username, err)
+			h.renderFavorites(w, r, "Could not remove the car from your favorites.")
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, "/ui/favorites", http.StatusSeeOther)
+}
+
 func (h *Handler) render(w http.ResponseWriter, name string, data any) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	if err := h.tmpl.ExecuteTemplate(w, name, data); err != nil {